@@ -0,0 +1,618 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/iptables"
+	"github.com/ulfox/iptlb/preflight"
+	"github.com/ulfox/iptlb/state"
+	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// parseArgs parses the command-line flags and returns the positional
+// arguments. Unlike flag.Parse, flags may also follow the positional
+// arguments, e.g. iptlb history test -state-file=local/state.db
+func parseArgs() []string {
+	flag.Parse()
+
+	var args []string
+	for flag.NArg() > 0 {
+		args = append(args, flag.Arg(0))
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+
+	return args
+}
+
+// printCommands are the subcommands that print their own output instead
+// of the -output=json result document
+var printCommands = map[string]bool{
+	"history":   true,
+	"doctor":    true,
+	"list":      true,
+	"status":    true,
+	"revisions": true,
+	"backups":   true,
+	"config":    true,
+}
+
+// runCommand dispatches the iptlb subcommands
+func runCommand(args []string, opts *iptables.OperatorOpts, logger *logrus.Logger, gc gcOpts, toRevision int, settings []setting) error {
+	switch args[0] {
+	case "history":
+		return historyCmd(opts, args[1:])
+	case "dest":
+		return destCmd(opts, logger, args[1:])
+	case "doctor":
+		return doctorCmd(opts, logger, args[1:])
+	case "failover":
+		return failoverCmd(opts, logger, args[1:])
+	case "enable", "disable":
+		return enableCmd(opts, logger, args[0], args[1:])
+	case "list":
+		return listCmd(opts, logger, args[1:])
+	case "status":
+		return statusCmd(opts, logger, args[1:])
+	case "gc":
+		return gcCmd(opts, logger, gc, args[1:])
+	case "purge":
+		return purgeCmd(opts, logger, args[1:])
+	case "revisions":
+		return revisionsCmd(opts, logger, args[1:])
+	case "rollback":
+		return rollbackCmd(opts, logger, toRevision, args[1:])
+	case "backups":
+		return backupsCmd(opts, logger, args[1:])
+	case "restore-backup":
+		return restoreBackupCmd(opts, logger, args[1:])
+	case "config":
+		return configCmd(settings, args[1:])
+	}
+
+	return fmt.Errorf("unknown command [%s]", args[0])
+}
+
+// historyCmd prints the audit log entries as json lines.
+// Usage: iptlb history [profile]
+func historyCmd(opts *iptables.OperatorOpts, args []string) error {
+	var profile string
+	if len(args) > 1 {
+		return fmt.Errorf("usage: iptlb history [profile]")
+	}
+	if len(args) == 1 {
+		profile = args[0]
+	}
+
+	entries, err := state.ReadAudit(state.AuditPath(opts.Path), profile)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	for i := range entries {
+		err = encoder.Encode(&entries[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// destCmd adds or removes destinations of an existing profile without
+// resetting it. Usage: iptlb dest [add/remove] profile ipv4:port[,ipv4:port...]
+func destCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 3 {
+		return fmt.Errorf("usage: iptlb dest [add/remove] profile ipv4:port[,ipv4:port...]")
+	}
+
+	opts.Profile = args[1]
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	dest := strings.Split(args[2], ",")
+	switch args[0] {
+	case "add":
+		return operator.AddDestinations(dest)
+	case "remove":
+		return operator.RemoveDestinations(dest)
+	}
+
+	return fmt.Errorf("unknown dest command [%s]. Expected add or remove", args[0])
+}
+
+// doctorCmd runs the preflight checks for every profile in the state, or only
+// for the given profile, and reports pass/fail with a fix hint for each check.
+// Usage: iptlb doctor [profile]
+func doctorCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: iptlb doctor [profile]")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	profiles := args
+	if len(profiles) == 0 {
+		profiles, err = operator.Storage.ListProfiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tPROFILE\tCHECK\tMESSAGE\tHINT")
+
+	var failed int
+	report := func(profile string, results []preflight.Result) {
+		for _, j := range results {
+			status, hint := "PASS", ""
+			if !j.Passed {
+				status, hint = "FAIL", j.Hint
+				failed++
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", status, profile, j.Check, j.Message, hint)
+		}
+	}
+
+	host := preflight.Run(preflight.Requirements{Modules: preflight.HostModules})
+	report("-", append(host, preflight.CheckIPTablesBackend(operator.Opts.Prefix+"_")))
+	for _, p := range profiles {
+		opts.Profile = p
+		err = operator.GetState()
+		if err != nil {
+			return err
+		}
+		err = operator.SetNetns()
+		if err != nil {
+			return err
+		}
+		report(p, preflight.Run(operator.Requirements()))
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d preflight checks failed", failed)
+	}
+
+	return nil
+}
+
+// failoverCmd checks the destination tiers of every profile with backup destinations,
+// or only of the given profile, and switches each to its highest healthy tier.
+// Usage: iptlb failover [profile]
+func failoverCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: iptlb failover [profile]")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	profiles := args
+	if len(profiles) == 0 {
+		profiles, err = operator.Storage.ListProfiles()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, p := range profiles {
+		opts.Profile = p
+		err = operator.Failover()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// enableCmd enables or disables a profile. A disabled profile keeps its state
+// but has no rules. Usage: iptlb [enable/disable] profile
+func enableCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, cmd string, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: iptlb %s profile", cmd)
+	}
+
+	// Like -delete, disable would otherwise mark the profile disabled and leave its rules
+	if cmd == "disable" && !opts.CreateRules {
+		return fmt.Errorf("disable requires -run also. This is to avoid disabling the profile in the state and leave its rules in the iptables")
+	}
+
+	opts.Profile = args[0]
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	if cmd == "disable" {
+		return operator.DisableProfile()
+	}
+	return operator.EnableProfile()
+}
+
+// selectProfiles returns the given profile, or the profiles that match -selector
+func selectProfiles(operator *iptables.Operator, args []string) ([]string, error) {
+	if len(args) == 1 {
+		return args, nil
+	}
+
+	return operator.SelectProfiles()
+}
+
+// listCmd prints the profiles of the state that match -selector.
+// Usage: iptlb list
+func listCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: iptlb list")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := operator.SelectProfiles()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tENABLED\tBACKEND\tSOURCE\tDESTINATIONS\tEXPIRES\tLABELS")
+	for _, p := range profiles {
+		opts.Profile = p
+		err = operator.GetState()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%t\t%s\t%s\t%s\t%s\t%s\n",
+			p,
+			operator.Opts.Enabled,
+			operator.Opts.RulesType,
+			operator.Opts.Src,
+			strings.Join(operator.Opts.Dest, ","),
+			expires(operator.Opts.ExpiresAt),
+			utils.FormatLabels(operator.Opts.Labels),
+		)
+	}
+
+	return w.Flush()
+}
+
+// expires returns the expiration time of a profile for listing
+func expires(expiresAt string) string {
+	if expiresAt == "" {
+		return "never"
+	}
+	return expiresAt
+}
+
+// statusCmd prints if the rules of the given profile, or of the profiles that
+// match -selector, are applied and if they drifted from the state. The drifted
+// rules are logged with -verbosity=debug. Usage: iptlb status [profile]
+func statusCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("usage: iptlb status [profile]")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := selectProfiles(operator, args)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROFILE\tENABLED\tAPPLIED\tDRIFT\tLABELS")
+	for _, p := range profiles {
+		opts.Profile = p
+		status, err := operator.Status()
+		if err != nil {
+			return err
+		}
+
+		drift := "-"
+		if status.Drift() {
+			drift = fmt.Sprintf("missing=%d,unexpected=%d", len(status.Missing), len(status.Unexpected))
+		}
+		fmt.Fprintf(
+			w,
+			"%s\t%t\t%s\t%s\t%s\n",
+			status.Profile,
+			status.Enabled,
+			status.Applied,
+			drift,
+			utils.FormatLabels(status.Labels),
+		)
+
+		log := logger.WithField("Profile", p)
+		for _, j := range status.Missing {
+			log.WithField("Rule", j).Debug("Missing rule")
+		}
+		for _, j := range status.Unexpected {
+			log.WithField("Rule", j).Debug("Unexpected rule")
+		}
+	}
+
+	return w.Flush()
+}
+
+// gcOpts are the options of the gc command
+type gcOpts struct {
+	Interval time.Duration
+	Orphans  bool
+}
+
+// gcCmd deletes the expired profiles and, with -orphans, the iptlb chains and rules
+// that no profile owns. With -gc-interval it keeps running and collects garbage at
+// every interval until SIGINT/SIGTERM. Usage: iptlb gc
+func gcCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, gc gcOpts, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: iptlb gc")
+	}
+	if !opts.CreateRules {
+		return fmt.Errorf("gc requires -run also. This is to avoid removing the state and leave lefovers in the iptables")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	collect := func() error {
+		_, err := operator.GC()
+		if !gc.Orphans {
+			return err
+		}
+
+		_, oerr := operator.CollectOrphans("gc-orphans", false)
+		if err == nil {
+			err = oerr
+		}
+		return err
+	}
+
+	err = collect()
+	if gc.Interval <= 0 {
+		return err
+	}
+
+	// A failed run does not stop the daemon. The profiles are tried again on the next tick
+	log := logger.WithFields(logrus.Fields{
+		"Stage":    "gc",
+		"Interval": gc.Interval,
+	})
+	if err != nil {
+		log.WithError(err).Warn(ipte.WarnGCRun)
+	}
+
+	osSignal := utils.NewOSSignal()
+	ticker := time.NewTicker(gc.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-osSignal.Signal:
+			return nil
+		case <-ticker.C:
+			err = collect()
+			if err != nil {
+				log.WithError(err).Warn(ipte.WarnGCRun)
+			}
+		}
+	}
+}
+
+// purgeCmd removes every iptlb chain and rule from all tables. The state is kept,
+// so the profiles can be applied again with -use-state. Usage: iptlb purge
+func purgeCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: iptlb purge")
+	}
+	if !opts.CreateRules {
+		return fmt.Errorf("purge requires -run also")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	_, err = operator.CollectOrphans("purge", true)
+	return err
+}
+
+// backupsCmd lists the backups of the state, oldest first. Usage: iptlb backups
+func backupsCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 0 {
+		return fmt.Errorf("usage: iptlb backups")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	backups, err := operator.ListBackups()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTIME\tACTION\tPROFILE\tNETNS\tTABLES")
+	for _, b := range backups {
+		fmt.Fprintf(
+			w,
+			"%s\t%s\t%s\t%s\t%s\t%s\n",
+			b.ID,
+			b.Timestamp.Format(time.RFC3339),
+			b.Action,
+			orDash(b.Profile),
+			orDash(b.Netns),
+			strings.Join(b.Tables, ","),
+		)
+	}
+
+	return w.Flush()
+}
+
+// restoreBackupCmd puts back the tables and the state of a backup.
+// Usage: iptlb restore-backup id
+func restoreBackupCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: iptlb restore-backup id")
+	}
+	if !opts.CreateRules {
+		return fmt.Errorf("restore-backup requires -run also")
+	}
+
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	return operator.RestoreBackup(args[0])
+}
+
+// configCmd prints the effective value of every flag and where it came from:
+// the command line, an IPTLB_* environment variable, the config file or the default.
+// Usage: iptlb config view
+func configCmd(settings []setting, args []string) error {
+	if len(args) != 1 || args[0] != "view" {
+		return fmt.Errorf("usage: iptlb config view")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FLAG\tVALUE\tSOURCE")
+	for _, j := range settings {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", j.Name, orDash(j.Value), j.Source)
+	}
+
+	return w.Flush()
+}
+
+// orDash returns s or - if s is empty, for listing
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// revisionsCmd lists the revisions of a profile, oldest first.
+// Usage: iptlb revisions profile
+func revisionsCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: iptlb revisions profile")
+	}
+
+	opts.Profile = args[0]
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := operator.Revisions()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "REVISION\tTIME\tBACKEND\tPROTOCOL\tSOURCE\tDESTINATIONS\tBACKUP")
+	for _, r := range revisions {
+		fmt.Fprintf(
+			w,
+			"%d\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			r.Revision,
+			r.Timestamp,
+			r.Opts.RulesType,
+			r.Opts.Protocol,
+			r.Opts.Src,
+			strings.Join(r.Opts.Dest, ","),
+			orDash(strings.Join(r.Opts.BackupDest, ",")),
+		)
+	}
+
+	return w.Flush()
+}
+
+// rollbackCmd re-applies an earlier revision of a profile with the reset path. Without
+// -to-revision the revision before the latest one is used.
+// Usage: iptlb rollback profile [-to-revision N]
+func rollbackCmd(opts *iptables.OperatorOpts, logger *logrus.Logger, toRevision int, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: iptlb rollback profile [-to-revision N]")
+	}
+	if toRevision < 0 {
+		return fmt.Errorf("-to-revision can not be negative")
+	}
+
+	opts.Profile = args[0]
+	operator, err := iptables.NewOperatorFactory(opts, logger)
+	if err != nil {
+		return err
+	}
+
+	return operator.Rollback(toRevision)
+}
+
+// summarizeReplay prints the outcome of each profile of a -use-state replay when
+// print is set and returns an error if any profile failed
+func summarizeReplay(results []iptables.ReplayResult, print bool) error {
+	var failed int
+	for _, j := range results {
+		if j.Err != nil {
+			failed++
+		}
+	}
+
+	if print {
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "STATUS\tPROFILE\tERROR")
+		for _, j := range results {
+			status, msg := "OK", "-"
+			switch {
+			case j.Err != nil:
+				status, msg = "FAIL", j.Err.Error()
+			case j.Skipped:
+				status = "SKIPPED"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", status, j.Profile, msg)
+		}
+
+		err := w.Flush()
+		if err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf(ipte.ErrReplayFailed, failed, len(results))
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// setting is the effective value of a flag and where it came from:
+// flag, env IPTLB_*, file path or default
+type setting struct {
+	Name, Value, Source string
+}
+
+// envName returns the IPTLB_* environment variable of flag name
+func envName(name string) string {
+	return utils.IPTLBPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// configIssues are the problems of the config sources that do not stop iptlb
+type configIssues struct {
+	// unknownEnv are the IPTLB_* environment variables that match no flag
+	unknownEnv []string
+	// unreadable is the error of the default config file when it exists but can
+	// not be read, e.g. by a user that is not root. The file is skipped
+	unreadable error
+}
+
+// loadConfig sets every flag that was not given on the command line from its
+// IPTLB_* environment variable or else from the config file (-config). The
+// precedence is flag > env > file > default. It returns the effective settings
+// and the issues of the sources that were skipped
+func loadConfig() ([]setting, configIssues, error) {
+	var issues configIssues
+
+	given := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+
+	// IPTLB_STATE_FILE is read as state.file by GetIPTLBEnv
+	env := make(map[string]string)
+	for k, v := range utils.GetIPTLBEnv(utils.IPTLBPrefix) {
+		name := strings.Replace(k, ".", "-", -1)
+		if flag.Lookup(name) == nil {
+			issues.unknownEnv = append(issues.unknownEnv, envName(name))
+			continue
+		}
+		env[name] = v
+	}
+	sort.Strings(issues.unknownEnv)
+
+	// A config file given with -config or IPTLB_CONFIG must exist
+	path := flag.Lookup("config").Value.String()
+	required := given["config"]
+	if v, ok := env["config"]; ok && !required {
+		path, required = v, true
+	}
+
+	file, err := utils.ReadConfigFile(path, required)
+	var perr *os.PathError
+	if err != nil && !required && errors.As(err, &perr) {
+		issues.unreadable = err
+		file, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return nil, issues, err
+	}
+	for k := range file {
+		if k == "config" || flag.Lookup(k) == nil {
+			return nil, issues, fmt.Errorf(ipte.ErrConfigKey, k, path)
+		}
+	}
+
+	var settings []setting
+	flag.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		s := setting{Name: f.Name, Source: "default"}
+		value, fromEnv := env[f.Name]
+		fromFile := false
+		if !fromEnv {
+			value, fromFile = file[f.Name]
+		}
+
+		switch {
+		case given[f.Name]:
+			s.Source = "flag"
+		case fromEnv:
+			s.Source = fmt.Sprintf("env %s", envName(f.Name))
+		case fromFile:
+			s.Source = fmt.Sprintf("file %s", path)
+		}
+
+		if !given[f.Name] && (fromEnv || fromFile) {
+			serr := f.Value.Set(value)
+			if serr != nil {
+				err = fmt.Errorf(ipte.ErrConfigValue, value, f.Name, s.Source, serr)
+				return
+			}
+		}
+
+		s.Value = f.Value.String()
+		settings = append(settings, s)
+	})
+	if err != nil {
+		return nil, issues, err
+	}
+
+	return settings, issues, nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testFlags replaces the command line flags with a config flag that defaults to
+// path, a profile flag that defaults to "default" and a dry-run flag, and parses args
+func testFlags(t *testing.T, path string, args ...string) {
+	t.Helper()
+
+	saved := flag.CommandLine
+	t.Cleanup(func() { flag.CommandLine = saved })
+
+	flag.CommandLine = flag.NewFlagSet("iptlb", flag.ContinueOnError)
+	flag.String("config", path, "")
+	flag.String("profile", "default", "")
+	flag.Bool("dry-run", false, "")
+	err := flag.CommandLine.Parse(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeConfig writes data to a config file in a temporary directory
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+
+	p := filepath.Join(t.TempDir(), "config.yaml")
+	err := ioutil.WriteFile(p, []byte(data), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name       string
+		flag       bool
+		env        bool
+		file       bool
+		wantValue  string
+		wantSource string
+	}{
+		{name: "all sources", flag: true, env: true, file: true, wantValue: "from-flag", wantSource: "flag"},
+		{name: "env and file", env: true, file: true, wantValue: "from-env", wantSource: "env IPTLB_PROFILE"},
+		{name: "file", file: true, wantValue: "from-file", wantSource: "file"},
+		{name: "default", wantValue: "default", wantSource: "default"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := "dry-run: true\n"
+			if tt.file {
+				data += "profile: from-file\n"
+			}
+			p := writeConfig(t, data)
+
+			var args []string
+			if tt.flag {
+				args = append(args, "-profile", "from-flag")
+			}
+			testFlags(t, p, args...)
+			if tt.env {
+				t.Setenv("IPTLB_PROFILE", "from-env")
+			}
+
+			settings, issues, err := loadConfig()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if issues.unknownEnv != nil || issues.unreadable != nil {
+				t.Errorf("unexpected issues %+v", issues)
+			}
+
+			want := map[string]setting{
+				"config":  {Name: "config", Value: p, Source: "default"},
+				"dry-run": {Name: "dry-run", Value: "true", Source: "file " + p},
+				"profile": {Name: "profile", Value: tt.wantValue, Source: tt.wantSource},
+			}
+			if tt.wantSource == "file" {
+				want["profile"] = setting{Name: "profile", Value: tt.wantValue, Source: "file " + p}
+			}
+			got := make(map[string]setting)
+			for _, j := range settings {
+				got[j.Name] = j
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("settings are %+v, expected %+v", got, want)
+			}
+			if v := flag.Lookup("profile").Value.String(); v != tt.wantValue {
+				t.Errorf("profile flag is %s, expected %s", v, tt.wantValue)
+			}
+		})
+	}
+}
+
+func TestLoadConfigIssues(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           string
+		env            map[string]string
+		args           []string
+		dir            bool
+		err            bool
+		wantUnknownEnv []string
+		wantUnreadable bool
+	}{
+		{
+			name: "unknown file key",
+			data: "profile: web\nprofiles: web\n",
+			err:  true,
+		},
+		{
+			name: "config key in file",
+			data: "config: /tmp/other.yaml\n",
+			err:  true,
+		},
+		{
+			name: "invalid file value",
+			data: "dry-run: maybe\n",
+			err:  true,
+		},
+		{
+			name:           "unknown env",
+			env:            map[string]string{"IPTLB_PROFILES": "web", "IPTLB_DRYRUN": "true", "IPTLB_PROFILE": "web"},
+			wantUnknownEnv: []string{"IPTLB_DRYRUN", "IPTLB_PROFILES"},
+		},
+		{
+			name:           "unreadable default file",
+			dir:            true,
+			wantUnreadable: true,
+		},
+		{
+			name: "unreadable file given with -config",
+			dir:  true,
+			args: []string{"-config"},
+			err:  true,
+		},
+		{
+			name: "unreadable file given with IPTLB_CONFIG",
+			dir:  true,
+			env:  map[string]string{"IPTLB_CONFIG": ""},
+			err:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// A directory can not be read as a config file, even by root
+			p := t.TempDir()
+			if !tt.dir {
+				p = writeConfig(t, tt.data)
+			}
+
+			args := tt.args
+			if len(args) > 0 {
+				args = append(args, p)
+			}
+			testFlags(t, p, args...)
+			for k, v := range tt.env {
+				if k == "IPTLB_CONFIG" {
+					v = p
+				}
+				t.Setenv(k, v)
+			}
+
+			_, issues, err := loadConfig()
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(issues.unknownEnv, tt.wantUnknownEnv) {
+				t.Errorf("unknown env is %q, expected %q", issues.unknownEnv, tt.wantUnknownEnv)
+			}
+			if (issues.unreadable != nil) != tt.wantUnreadable {
+				t.Errorf("unreadable is %v, expected %t", issues.unreadable, tt.wantUnreadable)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "config.yaml")
+
+	testFlags(t, p)
+	_, issues, err := loadConfig()
+	if err != nil {
+		t.Fatalf("missing default config file: %s", err)
+	}
+	if issues.unreadable != nil {
+		t.Errorf("missing default config file is reported unreadable: %s", issues.unreadable)
+	}
+
+	testFlags(t, p, "-config", p)
+	_, _, err = loadConfig()
+	if err == nil || !os.IsNotExist(err) {
+		t.Errorf("missing config file given with -config: %v, expected a not exist error", err)
+	}
+}
@@ -0,0 +1,310 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/state"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// SaveCmd is the binary used for the snapshots of the tables
+var SaveCmd = "iptables-save"
+
+// pendingBackup is the backup that audit prepares for an action. It is taken by
+// backup right before the action changes iptables for the first time
+type pendingBackup struct {
+	action, profile string
+	state           []byte
+	tables          []string
+}
+
+// prepareBackup keeps the current content of the state file for the backup of
+// action. Nothing is prepared without -run, with a retention of 0 or during a
+// batched replay, which takes one backup before it commits
+func (o *Operator) prepareBackup(action, profile string) error {
+	o.pending = nil
+	if !o.Opts.CreateRules || o.Opts.BackupRetention <= 0 || o.batch != nil {
+		return nil
+	}
+
+	data, err := o.Storage.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	o.pending = &pendingBackup{action: action, profile: profile, state: data}
+
+	return nil
+}
+
+// backup takes the prepared backup, if any, and removes the backups that
+// exceed operator.Opts.BackupRetention. The tables are saved in the current
+// network namespace. Every method that changes iptables calls backup first
+func (o *Operator) backup() error {
+	if o.pending == nil {
+		return nil
+	}
+	p := o.pending
+	o.pending = nil
+
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":   "Backup",
+		"Profile": p.profile,
+		"Action":  p.action,
+	})
+
+	tables := make(map[string][]byte)
+	for _, t := range Tables {
+		saved, err := o.saveTable(t)
+		if err != nil {
+			return err
+		}
+		if containsString(p.tables, t) || o.backupTable(t, string(saved)) {
+			tables[t] = saved
+		}
+	}
+
+	b := &state.Backup{
+		Timestamp: time.Now().UTC(),
+		Action:    p.action,
+		Profile:   p.profile,
+		Netns:     o.Opts.Netns,
+	}
+	dir := state.BackupsPath(o.Opts.Path)
+	err := state.SaveBackup(dir, b, tables, p.state)
+	if err != nil {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"Backup": b.ID,
+		"Tables": strings.Join(b.Tables, ","),
+	}).Info(ipte.InfoBackupSaved)
+
+	removed, err := state.PruneBackups(dir, o.Opts.BackupRetention)
+	for _, j := range removed {
+		log.WithField("Backup", j).Debug(ipte.InfoBackupPruned)
+	}
+
+	return err
+}
+
+// backupTable decides if table t, as saved by iptables-save, goes in the backup:
+// nat always, filter & mangle when the current operator.Opts will add rules to
+// them or they already hold chains or rules of the iptlb instance
+func (o *Operator) backupTable(t, saved string) bool {
+	switch {
+	case t == "nat":
+		return true
+	case t == "filter" && o.hasFilterRules():
+		return true
+	case t == "mangle" && o.Opts.LBMode == "hash":
+		return true
+	}
+
+	return strings.Contains(saved, o.chainPrefix()) ||
+		strings.Contains(saved, o.logPrefix()) ||
+		strings.Contains(saved, o.tagPrefix()) ||
+		strings.Contains(saved, hashSeed)
+}
+
+// saveTable returns the iptables-save output of table t
+func (o *Operator) saveTable(t string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(SaveCmd, "-t", t)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s: %s", SaveCmd, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return out, nil
+}
+
+// savedTable is a table as listed by iptables-save
+type savedTable struct {
+	name   string
+	chains []string
+	rules  map[string][]string
+}
+
+// parseSaved returns the table of the iptables-save output saved. The rules of
+// each chain are kept as they were listed, e.g. -A OUTPUT -p tcp ...
+func parseSaved(saved []byte) *savedTable {
+	t := &savedTable{rules: make(map[string][]string)}
+	for _, l := range strings.Split(string(saved), "\n") {
+		l = strings.TrimSpace(l)
+		switch {
+		case strings.HasPrefix(l, "*"):
+			t.name = l[1:]
+		case strings.HasPrefix(l, ":"):
+			t.chains = append(t.chains, strings.Fields(l[1:])[0])
+		case strings.HasPrefix(l, "-A "):
+			c := SplitRule(l)[1]
+			t.rules[c] = append(t.rules[c], l)
+		}
+	}
+
+	return t
+}
+
+// has reports if the table has chain c
+func (t *savedTable) has(c string) bool {
+	return containsString(t.chains, c)
+}
+
+// ownRule reports if a rule listed by iptables-save belongs to the iptlb instance:
+// it is tagged by the instance or it is an untagged rule of older versions
+func (o *Operator) ownRule(r string) bool {
+	rule := SplitRule(r)
+	if _, _, ok := o.ruleTag(rule); ok {
+		return true
+	}
+	_, ok := o.iptlbRule(rule)
+	return ok
+}
+
+// restoreTable puts back the chains and rules of the iptlb instance that the
+// iptables-save output saved holds, in a single iptables-restore --noflush
+// transaction. The chains of the instance get the saved rules and the ones that
+// were created later are deleted. In the other chains only the rules of the
+// instance are replaced. The saved ones are inserted at the top of their chain in
+// their saved order. Chains and rules of other software are left untouched
+func (o *Operator) restoreTable(saved []byte) error {
+	old := parseSaved(saved)
+	if old.name == "" {
+		return fmt.Errorf("%s: saved table has no *table line", RestoreCmd)
+	}
+
+	current, err := o.saveTable(old.name)
+	if err != nil {
+		return err
+	}
+	cur := parseSaved(current)
+
+	own := func(c string) bool {
+		return strings.HasPrefix(c, o.chainPrefix())
+	}
+
+	// The chains of the instance are flushed first, so the ones to delete are not
+	// referenced anymore once the rules that jump to them are removed
+	lines := []string{fmt.Sprintf("*%s", old.name)}
+	for _, t := range []*savedTable{old, cur} {
+		for _, c := range t.chains {
+			if own(c) && (t == old || !old.has(c)) {
+				lines = append(lines, fmt.Sprintf(":%s - [0:0]", c))
+			}
+		}
+	}
+	for _, c := range cur.chains {
+		if own(c) {
+			continue
+		}
+		for _, r := range cur.rules[c] {
+			if o.ownRule(r) {
+				lines = append(lines, "-D"+strings.TrimPrefix(r, "-A"))
+			}
+		}
+	}
+	for _, c := range cur.chains {
+		if own(c) && !old.has(c) {
+			lines = append(lines, fmt.Sprintf("-X %s", c))
+		}
+	}
+	for _, c := range old.chains {
+		if own(c) {
+			lines = append(lines, old.rules[c]...)
+		}
+	}
+	for _, c := range old.chains {
+		if own(c) || !cur.has(c) {
+			continue
+		}
+		p := 1
+		for _, r := range old.rules[c] {
+			if !o.ownRule(r) {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("-I %s %d%s", c, p, strings.TrimPrefix(r, "-A "+c)))
+			p++
+		}
+	}
+	lines = append(lines, "COMMIT", "")
+
+	return restore([]byte(strings.Join(lines, "\n")))
+}
+
+// ListBackups returns the backups of the state, oldest first
+func (o *Operator) ListBackups() ([]state.Backup, error) {
+	return state.ListBackups(state.BackupsPath(o.Opts.Path))
+}
+
+// RestoreBackup method puts back the chains and rules of the iptlb instance in the
+// tables of backup id (see restoreTable), in the network namespace they were saved in,
+// and the profiles of that namespace from the state of the backup. Profiles of other
+// namespaces keep their state, like their rules. The current tables and state are
+// backed up first, so a restore can be undone too
+func (o *Operator) RestoreBackup(id string) error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":  "RestoreBackup",
+		"Backup": id,
+	})
+
+	dir := state.BackupsPath(o.Opts.Path)
+	b, err := state.ReadBackup(dir, id)
+	if err != nil {
+		return err
+	}
+
+	// Read everything first, the backup of the current tables may prune this one
+	tables := make(map[string][]byte)
+	for _, t := range b.Tables {
+		tables[t], err = state.ReadBackupTable(dir, b, t)
+		if err != nil {
+			return err
+		}
+	}
+	data, err := state.ReadBackupState(dir, b)
+	if err != nil {
+		return err
+	}
+
+	o.Opts.Profile = ""
+	o.Opts.Netns = b.Netns
+
+	return o.audit("restore-backup", func() error {
+		err := o.SetNetns()
+		if err != nil {
+			return err
+		}
+
+		if o.pending != nil {
+			o.pending.tables = b.Tables
+		}
+		err = o.backup()
+		if err != nil {
+			return err
+		}
+
+		for _, t := range b.Tables {
+			err = o.restoreTable(tables[t])
+			if err != nil {
+				return err
+			}
+			o.Changes.TablesRestored = append(o.Changes.TablesRestored, t)
+			log.WithField("Table", t).Info(ipte.InfoBackupTableRestored)
+		}
+
+		err = o.Storage.RestoreNetnsState(data, b.Netns)
+		if err != nil {
+			return err
+		}
+		log.Info(ipte.InfoBackupRestored)
+
+		return nil
+	})
+}
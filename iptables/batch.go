@@ -0,0 +1,433 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/ulfox/iptlb/state"
+)
+
+// batchChain is the view of a chain that a restoreBatch changed. Rules are kept
+// as their arguments joined by spaces
+type batchChain struct {
+	exists  bool
+	flushed bool
+	added   []string
+	deleted []string
+}
+
+// batchLine is a line of the iptables-restore payload of a batch and the
+// profile whose replay wrote it
+type batchLine struct {
+	profile, table, line string
+}
+
+// batchTier is an active tier that a replay picked for profile. It is written to
+// the state once the changes of the profile are applied
+type batchTier struct {
+	profile string
+	tier    int
+}
+
+// batchAudit is an audited action of a replay. It is recorded once it is known
+// whether the changes of the profile were applied
+type batchAudit struct {
+	action  string
+	entry   *state.AuditEntry
+	changes state.RuleChanges
+	err     error
+}
+
+// restoreBatch collects the iptables changes of a replay instead of applying them.
+// The changes are applied by commit in a single iptables-restore transaction. The
+// chains the batch changed are read from the batch, every other chain from iptables.
+// The state writes and audit entries of the replay wait for the commit too
+type restoreBatch struct {
+	lines  []batchLine
+	chains map[string]*batchChain
+	tiers  []batchTier
+	audits []batchAudit
+}
+
+// batchCheckpoint is the state of a restoreBatch, see rollback
+type batchCheckpoint struct {
+	lines, tiers int
+	chains       map[string]*batchChain
+}
+
+// newRestoreBatch returns an empty restoreBatch
+func newRestoreBatch() *restoreBatch {
+	return &restoreBatch{chains: make(map[string]*batchChain)}
+}
+
+// batchKey returns the key of chain c of table t in restoreBatch.chains
+func batchKey(t, c string) string {
+	return fmt.Sprintf("%s/%s", t, c)
+}
+
+// removeString removes the first s from l and reports if it was found
+func removeString(l []string, s string) ([]string, bool) {
+	for i, j := range l {
+		if j == s {
+			return append(l[:i:i], l[i+1:]...), true
+		}
+	}
+	return l, false
+}
+
+// checkpoint returns the state of the batch, see rollback
+func (b *restoreBatch) checkpoint() batchCheckpoint {
+	chains := make(map[string]*batchChain, len(b.chains))
+	for k, j := range b.chains {
+		chains[k] = &batchChain{
+			exists:  j.exists,
+			flushed: j.flushed,
+			added:   append([]string{}, j.added...),
+			deleted: append([]string{}, j.deleted...),
+		}
+	}
+	return batchCheckpoint{lines: len(b.lines), tiers: len(b.tiers), chains: chains}
+}
+
+// rollback drops every change made to the batch after checkpoint returned c.
+// The audit entries are kept, they record the failure
+func (b *restoreBatch) rollback(c batchCheckpoint) {
+	b.lines = b.lines[:c.lines]
+	b.tiers = b.tiers[:c.tiers]
+	b.chains = c.chains
+}
+
+// add records line of table t for profile p
+func (b *restoreBatch) add(p, t, line string) {
+	b.lines = append(b.lines, batchLine{profile: p, table: t, line: line})
+}
+
+// chain returns the view of chain c of table t, or nil if the batch did not change it
+func (b *restoreBatch) chain(t, c string) *batchChain {
+	return b.chains[batchKey(t, c)]
+}
+
+// touch returns the view of chain c of table t and creates it from iptables first
+func (b *restoreBatch) touch(o *Operator, t, c string) (*batchChain, error) {
+	if ch := b.chain(t, c); ch != nil {
+		return ch, nil
+	}
+
+	exists, err := o.IPT.ChainExists(t, c)
+	if err != nil {
+		return nil, err
+	}
+	ch := &batchChain{exists: exists}
+	b.chains[batchKey(t, c)] = ch
+
+	return ch, nil
+}
+
+// addRule records that rule r was added to chain ch
+func (ch *batchChain) addRule(r string) {
+	var found bool
+	ch.deleted, found = removeString(ch.deleted, r)
+	if !found {
+		ch.added = append(ch.added, r)
+	}
+}
+
+// deleteRule records that rule r was removed from chain ch
+func (ch *batchChain) deleteRule(r string) {
+	var found bool
+	ch.added, found = removeString(ch.added, r)
+	if !found && !ch.flushed {
+		ch.deleted = append(ch.deleted, r)
+	}
+}
+
+// flush records that all the rules of chain ch were removed
+func (ch *batchChain) flush() {
+	ch.flushed = true
+	ch.added = nil
+	ch.deleted = nil
+}
+
+// record applies a line of an iptables-restore payload to the views of the batch
+func (b *restoreBatch) record(o *Operator, t, line string) error {
+	if strings.HasPrefix(line, ":") {
+		ch, err := b.touch(o, t, strings.Fields(line[1:])[0])
+		if err != nil {
+			return err
+		}
+		ch.exists = true
+		ch.flush()
+		return nil
+	}
+
+	args := SplitRule(line)
+	if len(args) < 2 {
+		return nil
+	}
+	ch, err := b.touch(o, t, args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "-A":
+		ch.addRule(strings.Join(args[2:], " "))
+	case "-D":
+		ch.deleteRule(strings.Join(args[2:], " "))
+	}
+
+	return nil
+}
+
+// payload returns the iptables-restore payload of the lines of the batch that
+// match keep, one *table section per table in the order the tables were first used
+func (b *restoreBatch) payload(keep func(batchLine) bool) []byte {
+	var tables []string
+	lines := make(map[string][]string)
+	for _, j := range b.lines {
+		if !keep(j) {
+			continue
+		}
+		if _, ok := lines[j.table]; !ok {
+			tables = append(tables, j.table)
+		}
+		lines[j.table] = append(lines[j.table], j.line)
+	}
+
+	var payload bytes.Buffer
+	for _, t := range tables {
+		fmt.Fprintf(&payload, "*%s\n", t)
+		for _, j := range lines[t] {
+			fmt.Fprintln(&payload, j)
+		}
+		fmt.Fprintln(&payload, "COMMIT")
+	}
+
+	return payload.Bytes()
+}
+
+// profiles returns the profiles that wrote lines to the batch, in order
+func (b *restoreBatch) profiles() []string {
+	var profiles []string
+	seen := make(map[string]bool)
+	for _, j := range b.lines {
+		if !seen[j.profile] {
+			seen[j.profile] = true
+			profiles = append(profiles, j.profile)
+		}
+	}
+	return profiles
+}
+
+// restoreCommand formats rule r of chain c as an iptables-restore line of command
+// cmd, e.g. "-D CHAIN" or "-I CHAIN 1"
+func restoreCommand(cmd, c string, r []string) string {
+	return cmd + strings.TrimPrefix(RestoreRule(c, r), fmt.Sprintf("-A %s", c))
+}
+
+// restore feeds payload to iptables-restore --noflush
+func restore(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(RestoreCmd, "--noflush")
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", RestoreCmd, err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// iptChainExists reports if chain c of table t exists
+func (o *Operator) iptChainExists(t, c string) (bool, error) {
+	if o.batch != nil {
+		if ch := o.batch.chain(t, c); ch != nil {
+			return ch.exists, nil
+		}
+	}
+	return o.IPT.ChainExists(t, c)
+}
+
+// iptExists reports if rule r exists in chain c of table t
+func (o *Operator) iptExists(t, c string, r ...string) (bool, error) {
+	if o.batch != nil {
+		if ch := o.batch.chain(t, c); ch != nil {
+			rule := strings.Join(r, " ")
+			for _, j := range ch.added {
+				if j == rule {
+					return true, nil
+				}
+			}
+			if !ch.exists || ch.flushed {
+				return false, nil
+			}
+			for _, j := range ch.deleted {
+				if j == rule {
+					return false, nil
+				}
+			}
+		}
+	}
+	return o.IPT.Exists(t, c, r...)
+}
+
+// iptList lists the rules of chain c of table t like iptables -S does
+func (o *Operator) iptList(t, c string) ([]string, error) {
+	if o.batch == nil {
+		return o.IPT.List(t, c)
+	}
+	ch := o.batch.chain(t, c)
+	if ch == nil {
+		return o.IPT.List(t, c)
+	}
+	if !ch.exists {
+		return nil, fmt.Errorf("chain %s does not exist in table %s", c, t)
+	}
+
+	// A chain the batch created or flushed has none of the rules of iptables
+	rules := []string{fmt.Sprintf("-N %s", c)}
+	if !ch.flushed {
+		listed, err := o.IPT.List(t, c)
+		if err != nil {
+			return nil, err
+		}
+		deleted := append([]string{}, ch.deleted...)
+		rules = rules[:0]
+		for _, j := range listed {
+			args := SplitRule(j)
+			if len(args) > 2 && args[0] == "-A" {
+				var found bool
+				deleted, found = removeString(deleted, strings.Join(args[2:], " "))
+				if found {
+					continue
+				}
+			}
+			rules = append(rules, j)
+		}
+	}
+	for _, j := range ch.added {
+		rules = append(rules, RestoreRule(c, SplitRule(j)))
+	}
+
+	return rules, nil
+}
+
+// iptNewChain creates chain c in table t
+func (o *Operator) iptNewChain(t, c string) error {
+	if o.batch == nil {
+		return o.IPT.NewChain(t, c)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	ch.exists = true
+	ch.flush()
+	o.batch.add(o.Opts.Profile, t, fmt.Sprintf("-N %s", c))
+
+	return nil
+}
+
+// iptClearChain removes all the rules of chain c of table t
+func (o *Operator) iptClearChain(t, c string) error {
+	if o.batch == nil {
+		return o.IPT.ClearChain(t, c)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	if !ch.exists {
+		ch.exists = true
+		ch.flush()
+		o.batch.add(o.Opts.Profile, t, fmt.Sprintf("-N %s", c))
+		return nil
+	}
+	ch.flush()
+	o.batch.add(o.Opts.Profile, t, fmt.Sprintf("-F %s", c))
+
+	return nil
+}
+
+// iptClearAndDeleteChain removes all the rules of chain c of table t and deletes it
+func (o *Operator) iptClearAndDeleteChain(t, c string) error {
+	if o.batch == nil {
+		return o.IPT.ClearAndDeleteChain(t, c)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	if !ch.exists {
+		return nil
+	}
+	ch.flush()
+	ch.exists = false
+	o.batch.add(o.Opts.Profile, t, fmt.Sprintf("-F %s", c))
+	o.batch.add(o.Opts.Profile, t, fmt.Sprintf("-X %s", c))
+
+	return nil
+}
+
+// iptInsert inserts rule r at position p of chain c of table t
+func (o *Operator) iptInsert(t, c string, p int, r ...string) error {
+	if o.batch == nil {
+		return o.IPT.Insert(t, c, p, r...)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	ch.addRule(strings.Join(r, " "))
+	o.batch.add(o.Opts.Profile, t, restoreCommand(fmt.Sprintf("-I %s %d", c, p), c, r))
+
+	return nil
+}
+
+// iptAppend appends rule r to chain c of table t
+func (o *Operator) iptAppend(t, c string, r ...string) error {
+	if o.batch == nil {
+		return o.IPT.Append(t, c, r...)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	ch.addRule(strings.Join(r, " "))
+	o.batch.add(o.Opts.Profile, t, RestoreRule(c, r))
+
+	return nil
+}
+
+// iptDelete removes rule r from chain c of table t
+func (o *Operator) iptDelete(t, c string, r ...string) error {
+	if o.batch == nil {
+		return o.IPT.Delete(t, c, r...)
+	}
+	ch, err := o.batch.touch(o, t, c)
+	if err != nil {
+		return err
+	}
+	ch.deleteRule(strings.Join(r, " "))
+	o.batch.add(o.Opts.Profile, t, restoreCommand(fmt.Sprintf("-D %s", c), c, r))
+
+	return nil
+}
+
+// addActiveTier writes the active tier of operator.Opts.Profile to the state.
+// During a batched replay it is written once the batch is committed
+func (o *Operator) addActiveTier(tier int) error {
+	if o.batch == nil {
+		return o.Storage.AddActiveTier(o.Opts.Profile, tier)
+	}
+	o.batch.tiers = append(o.batch.tiers, batchTier{profile: o.Opts.Profile, tier: tier})
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestBatchChain(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain batchChain
+		ops   func(ch *batchChain)
+		want  batchChain
+	}{
+		{
+			name:  "add",
+			chain: batchChain{exists: true},
+			ops:   func(ch *batchChain) { ch.addRule("-j A"); ch.addRule("-j B") },
+			want:  batchChain{exists: true, added: []string{"-j A", "-j B"}},
+		},
+		{
+			name:  "delete",
+			chain: batchChain{exists: true},
+			ops:   func(ch *batchChain) { ch.deleteRule("-j A") },
+			want:  batchChain{exists: true, deleted: []string{"-j A"}},
+		},
+		{
+			name:  "delete an added rule",
+			chain: batchChain{exists: true},
+			ops:   func(ch *batchChain) { ch.addRule("-j A"); ch.deleteRule("-j A") },
+			want:  batchChain{exists: true, added: []string{}},
+		},
+		{
+			name:  "add a deleted rule",
+			chain: batchChain{exists: true},
+			ops:   func(ch *batchChain) { ch.deleteRule("-j A"); ch.addRule("-j A") },
+			want:  batchChain{exists: true, deleted: []string{}},
+		},
+		{
+			name:  "delete from a flushed chain",
+			chain: batchChain{exists: true, flushed: true},
+			ops:   func(ch *batchChain) { ch.deleteRule("-j A") },
+			want:  batchChain{exists: true, flushed: true},
+		},
+		{
+			name:  "flush",
+			chain: batchChain{exists: true, added: []string{"-j A"}, deleted: []string{"-j B"}},
+			ops:   func(ch *batchChain) { ch.flush(); ch.addRule("-j C") },
+			want:  batchChain{exists: true, flushed: true, added: []string{"-j C"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch := tt.chain
+			tt.ops(&ch)
+			if !reflect.DeepEqual(ch, tt.want) {
+				t.Errorf("chain is %+v, expected %+v", ch, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchList(t *testing.T) {
+	tests := []struct {
+		name  string
+		chain *batchChain
+		want  []string
+		err   bool
+	}{
+		{
+			name:  "created chain",
+			chain: &batchChain{exists: true, flushed: true},
+			want:  []string{"-N C"},
+		},
+		{
+			name:  "flushed chain",
+			chain: &batchChain{exists: true, flushed: true, added: []string{"-j A", "-m comment --comment \"a b\" -j B"}},
+			want:  []string{"-N C", "-A C -j A", "-A C -m comment --comment \"a b\" -j B"},
+		},
+		{
+			name:  "deleted chain",
+			chain: &batchChain{flushed: true},
+			err:   true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOperator()
+			o.batch.chains[batchKey("nat", "C")] = tt.chain
+
+			rules, err := o.iptList("nat", "C")
+			if tt.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rules, tt.want) {
+				t.Errorf("listed %q, expected %q", rules, tt.want)
+			}
+		})
+	}
+}
+
+func TestBatchRollback(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(b *restoreBatch)
+	}{
+		{
+			name: "new lines and tiers",
+			ops: func(b *restoreBatch) {
+				b.add("b", "nat", "-A C -j B")
+				b.tiers = append(b.tiers, batchTier{profile: "b", tier: 1})
+			},
+		},
+		{
+			name: "changed chain",
+			ops: func(b *restoreBatch) {
+				b.chain("nat", "C").addRule("-j B")
+				b.chain("nat", "C").deleteRule("-j A")
+			},
+		},
+		{
+			name: "flushed chain",
+			ops:  func(b *restoreBatch) { b.chain("nat", "C").flush() },
+		},
+		{
+			name: "new chain",
+			ops: func(b *restoreBatch) {
+				b.chains[batchKey("nat", "D")] = &batchChain{exists: true, flushed: true}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newRestoreBatch()
+			b.add("a", "nat", "-A C -j A")
+			b.tiers = append(b.tiers, batchTier{profile: "a"})
+			b.chains[batchKey("nat", "C")] = &batchChain{exists: true, added: []string{"-j A"}}
+			b.audits = append(b.audits, batchAudit{action: "apply"})
+
+			c := b.checkpoint()
+			want := b.checkpoint()
+			tt.ops(b)
+			b.audits = append(b.audits, batchAudit{action: "apply"})
+			b.rollback(c)
+
+			if len(b.lines) != want.lines || len(b.tiers) != want.tiers {
+				t.Errorf("%d lines and %d tiers, expected %d and %d", len(b.lines), len(b.tiers), want.lines, want.tiers)
+			}
+			if !reflect.DeepEqual(b.chains, want.chains) {
+				t.Errorf("chains are %+v, expected %+v", b.chains, want.chains)
+			}
+			if len(b.audits) != 2 {
+				t.Errorf("%d audits, expected the 2 audits to be kept", len(b.audits))
+			}
+		})
+	}
+}
@@ -2,40 +2,42 @@ package iptables
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 	ipte "github.com/ulfox/iptlb/utils/logs"
 )
 
-// CreateChain for checking if a chain for a given table exists. In case it does not
-// it will create the chain. If operator.Opts.ChainLogging has been enabled, it will also
-// insert on entry 1 a logging rule
-// Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
-func (o *Operator) CreateChain() error {
+// ensureChain creates operator.Opts.Chain on operator.Opts.Table if it does not exist
+func (o *Operator) ensureChain() error {
 	log := o.Logger.WithFields(logrus.Fields{
 		"Stage": "createChain",
+		"Table": o.Opts.Table,
+		"Chain": o.Opts.Chain,
 	})
 
-	chainExists, err := o.IPT.ChainExists(o.Opts.Table, o.Opts.Chain)
+	chainExists, err := o.iptChainExists(o.Opts.Table, o.Opts.Chain)
 	if err != nil {
 		return err
 	}
 
 	if !chainExists {
-		log.Infof(
-			ipte.InfoChainDoesNotExist,
-			o.Opts.Chain,
-			o.Opts.Table,
-		)
-		err := o.IPT.NewChain(o.Opts.Table, o.Opts.Chain)
+		log.Info(ipte.InfoChainDoesNotExist)
+		err := o.backup()
 		if err != nil {
 			return err
 		}
+		err = o.iptNewChain(o.Opts.Table, o.Opts.Chain)
+		if err != nil {
+			return err
+		}
+		o.Changes.ChainsCreated = append(o.Changes.ChainsCreated, o.chainRecord())
 	} else {
-		log.Infof(ipte.InfoChainFound, o.Opts.Chain, o.Opts.Table)
+		log.Info(ipte.InfoChainFound)
+		o.Changes.ChainsUnchanged = append(o.Changes.ChainsUnchanged, o.chainRecord())
 	}
 
-	chainExists, err = o.IPT.ChainExists(o.Opts.Table, o.Opts.Chain)
+	chainExists, err = o.iptChainExists(o.Opts.Table, o.Opts.Chain)
 	if err != nil {
 		return err
 	}
@@ -43,36 +45,57 @@ func (o *Operator) CreateChain() error {
 		return fmt.Errorf(ipte.ErrChainNotFound, o.Opts.Table, o.Opts.Chain)
 	}
 
-	if !o.Opts.ChainLogging {
-		return nil
-	}
-
-	// Add verbose logging to chain
-	ruleArgs := []string{
-		"-j",
-		"LOG",
-		"--log-prefix",
-		fmt.Sprintf("%s:ACCEPT:", o.Opts.Chain),
-		"--log-level",
-		o.Opts.LogLevel,
-	}
-	err = o.AddRule(ruleArgs)
-	if err != nil {
-		log.Fatal(err)
-	}
-	log.Infof(ipte.InfoChainLoggingEnabled, o.Opts.Chain)
 	return nil
 }
 
 // FlushChain for removing all rules from a chain. Used before we delete the chain
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) FlushChain() error {
-	return o.IPT.ClearChain(o.Opts.Table, o.Opts.Chain)
+	err := o.backup()
+	if err != nil {
+		return err
+	}
+	return o.iptClearChain(o.Opts.Table, o.Opts.Chain)
 }
 
 // DeleteChain for deleting a chain. If we have any jump rules with that chain as target
-// the operation will fail.
+// the operation will fail. The rules of the chain are recorded as removed.
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) DeleteChain() error {
-	return o.IPT.ClearAndDeleteChain(o.Opts.Table, o.Opts.Chain)
+	exists, err := o.iptChainExists(o.Opts.Table, o.Opts.Chain)
+	if err != nil || !exists {
+		return err
+	}
+
+	listed, err := o.iptList(o.Opts.Table, o.Opts.Chain)
+	if err != nil {
+		return err
+	}
+
+	// Drop the -N CHAIN entry and the -A CHAIN prefix of the listed rules
+	var rules [][]string
+	for _, j := range listed {
+		if strings.HasPrefix(j, "-A ") {
+			rules = append(rules, SplitRule(j)[2:])
+		}
+	}
+	rules, err = o.createdForms(o.Opts.Table, o.Opts.Chain, rules)
+	if err != nil {
+		return err
+	}
+
+	err = o.backup()
+	if err != nil {
+		return err
+	}
+	err = o.iptClearAndDeleteChain(o.Opts.Table, o.Opts.Chain)
+	if err != nil {
+		return err
+	}
+	for _, r := range rules {
+		o.Changes.Removed = append(o.Changes.Removed, o.ruleRecord(r))
+	}
+	o.Changes.ChainsDeleted = append(o.Changes.ChainsDeleted, o.chainRecord())
+
+	return nil
 }
@@ -0,0 +1,154 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+	"github.com/vishvananda/netlink"
+)
+
+// DrainPollInterval is how often the conntrack table is checked while
+// waiting for the connections of a drained destination to reach zero
+var DrainPollInterval = time.Second
+
+// protocolNumbers maps the -protocol values to their IP protocol numbers
+var protocolNumbers = map[string]uint8{
+	"tcp":  6,
+	"udp":  17,
+	"sctp": 132,
+}
+
+// drainFilter matches the conntrack flows that were DNATed from the profile's
+// source address to a single destination. For redirected destinations the
+// reply address is the address of the incoming interface, so only the port is matched
+type drainFilter struct {
+	src, dest         net.IP
+	srcPort, destPort uint16
+	protocol          uint8
+	redirect          bool
+}
+
+// MatchConntrackFlow implements netlink.CustomConntrackFilter
+func (f *drainFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	if f.protocol != 0 && flow.Forward.Protocol != f.protocol {
+		return false
+	}
+
+	return f.src.Equal(flow.Forward.DstIP) &&
+		f.srcPort == flow.Forward.DstPort &&
+		(f.redirect || f.dest.Equal(flow.Reverse.SrcIP)) &&
+		f.destPort == flow.Reverse.SrcPort
+}
+
+func splitHostPort(s string) (net.IP, uint16, error) {
+	addrSlice := strings.Split(s, ":")
+	if len(addrSlice) != 2 {
+		return nil, 0, fmt.Errorf("address [%s] is not valid. Expected ip:port", s)
+	}
+
+	ip := net.ParseIP(addrSlice[0])
+	if ip == nil {
+		return nil, 0, fmt.Errorf(ipte.ErrInvalidIPV4, addrSlice[0])
+	}
+
+	port, err := strconv.ParseUint(addrSlice[1], 10, 16)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ip, uint16(port), nil
+}
+
+// newDrainFilter creates the conntrack filter of destination d for operator.Opts.Src
+// and operator.Opts.Protocol
+func (o *Operator) newDrainFilter(d string) (*drainFilter, error) {
+	src, srcPort, err := splitHostPort(o.Opts.Src)
+	if err != nil {
+		return nil, err
+	}
+
+	dest, destPort, err := splitHostPort(d)
+	if err != nil {
+		return nil, err
+	}
+
+	return &drainFilter{
+		src:      src,
+		srcPort:  srcPort,
+		dest:     dest,
+		destPort: destPort,
+		protocol: protocolNumbers[strings.ToLower(o.Opts.Protocol)],
+		redirect: o.isRedirect(d),
+	}, nil
+}
+
+// countFlows returns the number of conntrack entries that match filter f
+func countFlows(f *drainFilter) (int, error) {
+	flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, netlink.FAMILY_V4)
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, flow := range flows {
+		if f.MatchConntrackFlow(flow) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// DrainDestinations method for draining destinations that have already been removed
+// from the profile's chain, so no new connections reach them. Unless operator.Opts.DrainForce
+// is set, it waits until the destination has no conntrack entries left or until
+// operator.Opts.DrainGrace has passed. Then it deletes the remaining conntrack entries
+// of the destination, so established flows (e.g. udp) stop being sent to it.
+// Method uses operator.Opts.Src & operator.Opts.Protocol
+func (o *Operator) DrainDestinations(dest []string) error {
+	filters := make(map[string]*drainFilter, len(dest))
+	for _, j := range dest {
+		f, err := o.newDrainFilter(j)
+		if err != nil {
+			return err
+		}
+		filters[j] = f
+	}
+
+	deadline := time.Now().Add(o.Opts.DrainGrace)
+	for j, f := range filters {
+		log := o.Logger.WithFields(logrus.Fields{
+			"Stage":       "DrainDestinations",
+			"Profile":     o.Opts.Profile,
+			"Destination": j,
+		})
+
+		if !o.Opts.DrainForce {
+			log.WithField("Grace", o.Opts.DrainGrace.String()).Info(ipte.InfoDrainStart)
+			for {
+				n, err := countFlows(f)
+				if err != nil {
+					return err
+				}
+				if n == 0 || !time.Now().Before(deadline) {
+					log.WithField("Connections", n).Info(ipte.InfoDrainDone)
+					break
+				}
+				time.Sleep(DrainPollInterval)
+			}
+		}
+
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, netlink.FAMILY_V4, f)
+		if err != nil {
+			return err
+		}
+		log.WithField("Entries", n).Info(ipte.InfoConntrackFlushed)
+	}
+
+	return nil
+}
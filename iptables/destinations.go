@@ -0,0 +1,272 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// AddDestinations method for adding destinations to an existing profile.
+// The custom nat chain is replaced atomically with the recomputed LB rules,
+// the jump rule is left in place
+func (o *Operator) AddDestinations(dest []string) error {
+	return o.audit("dest-add", func() error {
+		err := o.loadProfile()
+		if err != nil {
+			return err
+		}
+
+		newDest := append([]string{}, o.Opts.Dest...)
+		for _, j := range dest {
+			if containsString(newDest, j) {
+				return fmt.Errorf(ipte.ErrDestAlreadyExists, j, o.Opts.Profile)
+			}
+			newDest = append(newDest, j)
+		}
+
+		return o.updateDestinations(newDest)
+	})
+}
+
+// RemoveDestinations method for removing destinations from an existing profile.
+// The custom nat chain is replaced atomically with the recomputed LB rules,
+// the jump rule is left in place. If operator.Opts.Drain is set, the conntrack
+// entries of the removed destinations are drained afterwards (see DrainDestinations)
+func (o *Operator) RemoveDestinations(dest []string) error {
+	return o.audit("dest-remove", func() error {
+		err := o.loadProfile()
+		if err != nil {
+			return err
+		}
+
+		for _, j := range dest {
+			if !containsString(o.Opts.Dest, j) {
+				return fmt.Errorf(ipte.ErrDestNotExist, j, o.Opts.Profile)
+			}
+		}
+
+		var newDest []string
+		for _, j := range o.Opts.Dest {
+			if !containsString(dest, j) {
+				newDest = append(newDest, j)
+			}
+		}
+
+		err = o.updateDestinations(newDest)
+		if err != nil {
+			return err
+		}
+
+		if o.Opts.Drain && o.Opts.CreateRules {
+			return o.DrainDestinations(dest)
+		}
+		return nil
+	})
+}
+
+// loadProfile reads the state of operator.Opts.Profile into operator.Opts.
+// It fails if the profile does not exist
+func (o *Operator) loadProfile() error {
+	exists, err := o.ProfileExists()
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf(ipte.ErrProfileNotExist, o.Opts.Profile)
+	}
+
+	return o.GetState()
+}
+
+// updateDestinations validates dest, writes it to the profile state and, when
+// operator.Opts.CreateRules is set and the profile is enabled, replaces the rules
+// of the custom nat chain
+func (o *Operator) updateDestinations(dest []string) error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":   "updateDestinations",
+		"Profile": o.Opts.Profile,
+	})
+
+	err := o.Opts.CheckInput(o.Opts.Src, dest)
+	if err != nil {
+		return err
+	}
+	for _, j := range dest {
+		err = o.CheckIPV4(j)
+		if err != nil {
+			return err
+		}
+	}
+
+	oldRules := o.chainRules()
+	o.Opts.Dest = dest
+
+	// The host checks of CheckTargets run in the profile's namespace
+	err = o.SetNetns()
+	if err != nil {
+		return err
+	}
+	err = o.CheckTargets()
+	if err != nil {
+		return err
+	}
+
+	// Disabled profiles have no chain, their rules are applied on enable
+	var newRules [][]string
+	replaced := false
+	if o.Opts.CreateRules && o.Opts.Enabled {
+		// The primary tier changed, so the highest healthy tier may have changed too
+		o.Opts.ActiveTier = o.selectTier()
+		newRules = o.chainRules()
+
+		o.Target("nat", o.GetChainName("nat"))
+
+		exists, err := o.iptChainExists(o.Opts.Table, o.Opts.Chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf(ipte.ErrChainNotApplied, o.Opts.Table, o.Opts.Chain, o.Opts.Profile)
+		}
+
+		err = o.ReplaceChain(newRules)
+		if err != nil {
+			return err
+		}
+		replaced = true
+	}
+
+	err = o.writeDestinations(dest)
+	if err != nil {
+		// Keep iptables in line with the state that could not be written
+		if replaced {
+			rerr := o.Target("nat", o.GetChainName("nat")).ReplaceChain(oldRules)
+			if rerr != nil {
+				log.WithError(rerr).Error(ipte.ErrRevertChain)
+			} else {
+				log.Warn(ipte.WarnChainReverted)
+			}
+		}
+		return err
+	}
+	if replaced {
+		o.recordReplace(oldRules, newRules)
+	}
+
+	log.WithField("Destinations", strings.Join(dest, ",")).Info(ipte.InfoDestUpdated)
+
+	return nil
+}
+
+// writeDestinations writes dest, the active tier and a new revision to the
+// state of operator.Opts.Profile
+func (o *Operator) writeDestinations(dest []string) error {
+	err := o.Storage.UpdateDestinations(o.Opts.Profile, dest)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddActiveTier(o.Opts.Profile, o.Opts.ActiveTier)
+	if err != nil {
+		return err
+	}
+
+	return o.addRevision()
+}
+
+// chainRules returns the full content of the custom nat chain for the
+// current operator.Opts: the optional LOG rule followed by lbRules
+func (o *Operator) chainRules() [][]string {
+	var rules [][]string
+
+	if o.Opts.ChainLogging {
+		rules = append(rules, o.tag(GetChainLogRule(o.GetChainName("nat"), o.Opts.LogLevel), RoleChainLog, ""))
+	}
+
+	return append(rules, o.lbRules()...)
+}
+
+// lbRules returns the rules that NATLBRules maintains in the custom nat chain:
+// the denied client cidrs, the LB rules of operator.Opts.LBMode for the active
+// tier, the fallback destination and RETURN
+func (o *Operator) lbRules() [][]string {
+	var rules [][]string
+
+	_, deny := utils.SplitClientCIDRs(o.Opts.ClientCIDR)
+	for _, c := range deny {
+		rules = append(rules, o.tag(GetClientDenyRule(c), RoleDeny, c))
+	}
+
+	if o.Opts.LBMode == "hash" {
+		rules = append(rules, o.hashLBRules()...)
+		return append(append(rules, o.fallbackRules()...), o.tag([]string{"-j", "RETURN"}, RoleReturn, ""))
+	}
+
+	dest := o.activeDest()
+	srcAddrSlice := strings.Split(o.Opts.Src, ":")
+	for i, j := range dest {
+		rule := GetLBRule(o.Opts.Protocol, srcAddrSlice[0], srcAddrSlice[1], len(dest), i, o.lbTarget(j))
+		rules = append(rules, o.tag(o.withConnLimit(rule), RoleLB, j))
+	}
+
+	return append(append(rules, o.fallbackRules()...), o.tag([]string{"-j", "RETURN"}, RoleReturn, ""))
+}
+
+// fallbackRules returns the unconditional DNAT to operator.Opts.FallbackDest. It is
+// reached when the profile has no destinations or all of them are full.
+// A -fallback=reject is done in the custom filter chain, since REJECT is not
+// allowed in nat (see limitRules)
+func (o *Operator) fallbackRules() [][]string {
+	if o.Opts.FallbackDest == "" {
+		return nil
+	}
+
+	srcAddrSlice := strings.Split(o.Opts.Src, ":")
+	rule := []string{
+		"-p",
+		o.Opts.Protocol,
+		"-d",
+		srcAddrSlice[0],
+		"--dport",
+		srcAddrSlice[1],
+	}
+
+	return [][]string{o.tag(append(rule, o.lbTarget(o.Opts.FallbackDest)...), RoleFallback, o.Opts.FallbackDest)}
+}
+
+// recordReplace records the difference between the old and the new chain
+// content after a ReplaceChain. Rules in both are recorded as unchanged
+func (o *Operator) recordReplace(oldRules, newRules [][]string) {
+	oldSet := make(map[string]bool)
+	for _, r := range oldRules {
+		oldSet[strings.Join(r, " ")] = true
+	}
+	newSet := make(map[string]bool)
+	for _, r := range newRules {
+		newSet[strings.Join(r, " ")] = true
+	}
+
+	for _, r := range oldRules {
+		if !newSet[strings.Join(r, " ")] {
+			o.Changes.Removed = append(o.Changes.Removed, o.ruleRecord(r))
+		}
+	}
+	for _, r := range newRules {
+		if !oldSet[strings.Join(r, " ")] {
+			o.Changes.Added = append(o.Changes.Added, o.ruleRecord(r))
+			continue
+		}
+		o.Changes.Unchanged = append(o.Changes.Unchanged, o.ruleRecord(r))
+	}
+}
+
+func containsString(s []string, v string) bool {
+	for _, j := range s {
+		if j == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,82 @@
+package iptables
+
+import (
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// DisableProfile method removes the chains and rules of operator.Opts.Profile and
+// keeps the profile in the state with enabled set to false. Disabled profiles are
+// skipped by -use-state. If operator.Opts.Drain is set, the conntrack entries of
+// the profile's destinations are drained afterwards (see DrainDestinations)
+func (o *Operator) DisableProfile() error {
+	return o.audit("disable", func() error {
+		log := o.Logger.WithFields(logrus.Fields{
+			"Stage":   "DisableProfile",
+			"Profile": o.Opts.Profile,
+		})
+
+		err := o.loadProfile()
+		if err != nil {
+			return err
+		}
+
+		if o.Opts.CreateRules {
+			err = o.removeRules()
+			if err != nil {
+				return err
+			}
+		}
+
+		err = o.Storage.AddEnabled(o.Opts.Profile, false)
+		if err != nil {
+			return err
+		}
+		log.Info(ipte.InfoProfileDisabled)
+
+		if o.Opts.Drain && o.Opts.CreateRules {
+			return o.DrainDestinations(o.targets())
+		}
+		return nil
+	})
+}
+
+// EnableProfile method sets enabled to true for operator.Opts.Profile and, when
+// operator.Opts.CreateRules is set, applies its chains and rules from the state
+func (o *Operator) EnableProfile() error {
+	return o.audit("enable", func() error {
+		log := o.Logger.WithFields(logrus.Fields{
+			"Stage":   "EnableProfile",
+			"Profile": o.Opts.Profile,
+		})
+
+		err := o.loadProfile()
+		if err != nil {
+			return err
+		}
+
+		err = o.Storage.AddEnabled(o.Opts.Profile, true)
+		if err != nil {
+			return err
+		}
+
+		if o.Opts.CreateRules {
+			err = o.SetNetns()
+			if err != nil {
+				return err
+			}
+			err = o.CheckTargets()
+			if err != nil {
+				return err
+			}
+
+			err = o.applyRules()
+			if err != nil {
+				return err
+			}
+		}
+		log.Info(ipte.InfoProfileEnabled)
+
+		return nil
+	})
+}
@@ -0,0 +1,116 @@
+package iptables
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// Expired method returns true if operator.Opts.ExpiresAt is set and has passed
+func (o *Operator) Expired(now time.Time) (bool, error) {
+	if o.Opts.ExpiresAt == "" {
+		return false, nil
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339, o.Opts.ExpiresAt)
+	if err != nil {
+		return false, err
+	}
+
+	return !now.Before(expiresAt), nil
+}
+
+// GC method deletes every expired profile in the state with the same logic as -delete,
+// including its chains and rules, and returns the deleted profiles.
+// If operator.Opts.Drain is set, the conntrack entries of their destinations are drained.
+// The state is read again first, since gc -interval keeps running while other iptlb
+// runs change it. A profile that fails is logged and does not stop the others.
+// Method reads each profile into operator.Opts and restores operator.Opts.Netns
+func (o *Operator) GC() ([]string, error) {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage": "GC",
+	})
+
+	netns := o.Opts.Netns
+	defer func() {
+		o.Opts.Netns = netns
+	}()
+
+	err := o.Storage.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var deleted []string
+	var failed int
+	for _, p := range profiles {
+		err = o.gcProfile(p, now)
+		switch {
+		case err == errNotExpired:
+			continue
+		case err != nil:
+			log.WithField("Profile", p).WithError(err).Warn(ipte.WarnGCProfile)
+			failed++
+			continue
+		}
+		deleted = append(deleted, p)
+	}
+
+	log.WithField("Deleted", len(deleted)).Info(ipte.InfoGCDone)
+
+	if failed > 0 {
+		return deleted, fmt.Errorf(ipte.ErrGCFailed, failed)
+	}
+	return deleted, nil
+}
+
+// errNotExpired is returned by gcProfile for a profile that has not expired
+var errNotExpired = errors.New("profile has not expired")
+
+// gcProfile deletes profile p if it has expired at now
+func (o *Operator) gcProfile(p string, now time.Time) error {
+	o.Opts.Profile = p
+	err := o.GetState()
+	if err != nil {
+		return err
+	}
+
+	expired, err := o.Expired(now)
+	if err != nil {
+		return err
+	}
+	if !expired {
+		return errNotExpired
+	}
+
+	o.Logger.WithFields(logrus.Fields{
+		"Stage":     "GC",
+		"Profile":   p,
+		"ExpiresAt": o.Opts.ExpiresAt,
+	}).Info(ipte.InfoProfileExpired)
+
+	return o.audit("gc", func() error {
+		dest := o.targets()
+		err := o.DeleteProfile()
+		if err != nil {
+			return err
+		}
+
+		if o.Opts.Drain && o.Opts.CreateRules {
+			err = o.DrainDestinations(dest)
+			if err != nil {
+				return err
+			}
+		}
+		return o.releaseNetns(o.Opts.Netns)
+	})
+}
@@ -0,0 +1,315 @@
+package iptables
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+const (
+	// HashBuckets is the number of HMARK buckets that hash mode spreads the clients over.
+	// Each bucket is owned by one destination, so removing a destination only moves
+	// the clients of its own buckets
+	HashBuckets = 64
+
+	// HashMarkOffset is the first packet mark that hash mode uses. Marks
+	// HashMarkOffset to HashMarkOffset+HashBuckets-1 are set by the HMARK rule.
+	// Bit 0x2000 tells the marks of iptlb apart from unmarked packets
+	HashMarkOffset = 0x2000
+
+	// HashMarkMask holds the mark bits that hash mode reserves: the bit of
+	// HashMarkOffset and the bucket bits. The LB rules only match these bits and
+	// the hash mark rules keep every other bit of the packet mark, e.g. the
+	// 0x4000/0x8000 bits of kube-proxy and the 0xffff0000 bits of Calico
+	HashMarkMask = HashMarkOffset | (HashBuckets - 1)
+
+	// hashSeed feeds the HMARK hash so clients map to the same bucket on every host
+	hashSeed = "0x1b4e7a5d"
+)
+
+// hashMangleChain returns the mangle chain where the HMARK rule is applied.
+// It is the mangle counterpart of the nat chain that holds the jump rules
+func (o *Operator) hashMangleChain() string {
+	if o.Opts.RulesType == "client" {
+		return "OUTPUT"
+	}
+	return "PREROUTING"
+}
+
+// hashKeepMask returns the mark bits that hash mode does not reserve, as used
+// by the CONNMARK masks of the hash mark rules
+func hashKeepMask() string {
+	return fmt.Sprintf("0x%x", uint32(0xffffffff)&^uint32(HashMarkMask))
+}
+
+// getHMARKRule returns the untagged rule that marks new connections to
+// operator.Opts.Src with a bucket derived from the client address (and port
+// when operator.Opts.HashPort is set). HMARK sets the whole packet mark
+func (o *Operator) getHMARKRule() []string {
+	tuple := "src"
+	if o.Opts.HashPort {
+		tuple = "src,sport"
+	}
+
+	return append(
+		o.hashMarkMatch(),
+		"-j",
+		"HMARK",
+		"--hmark-tuple",
+		tuple,
+		"--hmark-mod",
+		fmt.Sprintf("%d", HashBuckets),
+		"--hmark-offset",
+		fmt.Sprintf("0x%x", HashMarkOffset),
+		"--hmark-rnd",
+		hashSeed,
+	)
+}
+
+// hashMarkMatch returns the match of the new connections to operator.Opts.Src
+// that the hash mark rules apply to
+func (o *Operator) hashMarkMatch() []string {
+	rule := []string{
+		"-p",
+		o.Opts.Protocol,
+	}
+	rule = append(rule, o.interfaceMatch()...)
+
+	return append(
+		rule,
+		"-d",
+		strings.Split(o.Opts.Src, ":")[0],
+		"--dport",
+		strings.Split(o.Opts.Src, ":")[1],
+		"-m",
+		"conntrack",
+		"--ctstate",
+		"NEW",
+	)
+}
+
+// GetHashMarkRules method returns the tagged mangle rules that set the bucket of
+// the new connections to operator.Opts.Src in the HashMarkMask bits of the packet
+// mark, in the order they run. Since HMARK sets the whole mark, the other bits are
+// kept in the connection mark while HMARK runs and are put back after it. The kept
+// bits of the connection mark are cleared at the end; the mark of a new connection
+// is still unset in the first rules of mangle
+func (o *Operator) GetHashMarkRules() [][]string {
+	keep := hashKeepMask()
+	connmark := func(args ...string) []string {
+		return o.tag(append(append(o.hashMarkMatch(), "-j", "CONNMARK"), args...), RoleHashMark, "")
+	}
+
+	return [][]string{
+		connmark("--save-mark", "--nfmask", keep, "--ctmask", keep),
+		o.tag(o.getHMARKRule(), RoleHashMark, ""),
+		connmark("--restore-mark", "--nfmask", keep, "--ctmask", keep),
+		connmark("--set-xmark", fmt.Sprintf("0x0/%s", keep)),
+	}
+}
+
+// HashMarkRules for inserting (t=true) or removing the hash mark rules of the profile
+// on the mangle chain that runs before the nat jump rules
+func (o *Operator) HashMarkRules(t bool) error {
+	o.Target("mangle", o.hashMangleChain())
+
+	rules := o.GetHashMarkRules()
+	if !t {
+		for _, j := range rules {
+			err := o.RemoveRule(j)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	inPlace, err := o.hashMarkInPlace(rules)
+	if err != nil {
+		return err
+	}
+	if !inPlace {
+		err = o.removeHashMarkRules()
+		if err != nil {
+			return err
+		}
+	}
+
+	// The rules only work in their order, so they are inserted on top of the chain last to first
+	for i := len(rules) - 1; i >= 0; i-- {
+		err = o.InsertRule(1, rules[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hashMarkRules returns the rules of operator.Opts.Chain that are tagged as the hash
+// mark rules of the profile, in the order iptables -S lists them
+func (o *Operator) hashMarkRules() ([][]string, error) {
+	listed, err := o.iptList(o.Opts.Table, o.Opts.Chain)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules [][]string
+	tag := o.GetTag(o.Opts.Profile, RoleHashMark, "")
+	for _, r := range listed {
+		rule := SplitRule(r)
+		if len(rule) > 2 && rule[0] == "-A" && ruleArg(rule, "--comment") == tag {
+			rules = append(rules, rule[2:])
+		}
+	}
+
+	return rules, nil
+}
+
+// hashMarkInPlace reports if operator.Opts.Chain has exactly the hash mark rules
+// of the profile in their order
+func (o *Operator) hashMarkInPlace(rules [][]string) (bool, error) {
+	listed, err := o.hashMarkRules()
+	if err != nil {
+		return false, err
+	}
+	if len(listed) != len(rules) {
+		return false, nil
+	}
+
+	// iptables normalizes the listed rules, so they are compared by their target
+	for i, j := range rules {
+		if ruleArg(listed[i], "-j") != ruleArg(j, "-j") {
+			return false, nil
+		}
+		exists, err := o.iptExists(o.Opts.Table, o.Opts.Chain, j...)
+		if err != nil {
+			return false, err
+		}
+		if !exists {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// removeHashMarkRules removes the hash mark rules of the profile from operator.Opts.Chain,
+// e.g. the lone HMARK rule of older versions or rules that are out of order
+func (o *Operator) removeHashMarkRules() error {
+	listed, err := o.hashMarkRules()
+	if err != nil {
+		return err
+	}
+
+	forms, err := o.createdForms(o.Opts.Table, o.Opts.Chain, listed)
+	if err != nil {
+		return err
+	}
+	for _, j := range forms {
+		err = o.RemoveRule(j)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// hashOwner returns the destination that owns bucket b. Owners are picked
+// with rendezvous hashing: the destination with the highest score wins, so
+// adding or removing a destination only changes the owner of its own buckets
+func hashOwner(dest []string, b int) int {
+	var owner int
+	var best uint32
+
+	for i, j := range dest {
+		h := fnv.New32a()
+		fmt.Fprintf(h, "%s/%d", j, b)
+		if score := mix32(h.Sum32()); i == 0 || score > best {
+			owner, best = i, score
+		}
+	}
+
+	return owner
+}
+
+// mix32 is the murmur3 finalizer. FNV alone mixes the high bits of short,
+// similar inputs poorly, which would skew the bucket owners
+func mix32(h uint32) uint32 {
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// hashBlock is an aligned range of buckets that belongs to one destination
+type hashBlock struct {
+	start, size, owner int
+}
+
+// mark returns the mark/mask that matches the buckets of block b
+func (b hashBlock) mark() string {
+	return fmt.Sprintf("0x%x/0x%x", HashMarkOffset+b.start, HashMarkMask&^(b.size-1))
+}
+
+// hashBlocks groups the buckets into the largest aligned power of two blocks
+// that have a single owner, so each block can be matched with one mark/mask
+func hashBlocks(owners []int, start, size int) []hashBlock {
+	for _, j := range owners[start : start+size] {
+		if j != owners[start] {
+			half := size / 2
+			return append(
+				hashBlocks(owners, start, half),
+				hashBlocks(owners, start+half, half)...,
+			)
+		}
+	}
+
+	return []hashBlock{{start: start, size: size, owner: owners[start]}}
+}
+
+// hashLBRules returns the DNAT (or REDIRECT) rules of hash mode. Each rule
+// matches the marks of a block of buckets and sends them to its owner in the active tier
+func (o *Operator) hashLBRules() [][]string {
+	dest := o.activeDest()
+	if len(dest) == 0 {
+		return nil
+	}
+
+	owners := make([]int, HashBuckets)
+	for b := range owners {
+		owners[b] = hashOwner(dest, b)
+	}
+
+	srcAddrSlice := strings.Split(o.Opts.Src, ":")
+
+	var rules [][]string
+	for _, j := range hashBlocks(owners, 0, HashBuckets) {
+		rule := []string{
+			"-p",
+			o.Opts.Protocol,
+			"-d",
+			srcAddrSlice[0],
+			"--dport",
+			srcAddrSlice[1],
+			"-m",
+			"mark",
+			"--mark",
+			j.mark(),
+		}
+		rules = append(rules, o.tag(o.withConnLimit(append(rule, o.lbTarget(dest[j.owner])...)), RoleLB, dest[j.owner]))
+	}
+
+	return rules
+}
+
+// lbTarget returns the target part of a LB rule for destination d
+func (o *Operator) lbTarget(d string) []string {
+	if o.isRedirect(d) {
+		return []string{"-j", "REDIRECT", "--to-ports", strings.Split(d, ":")[1]}
+	}
+	return []string{"-j", "DNAT", "--to-destination", d}
+}
@@ -0,0 +1,162 @@
+package iptables
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseMark parses a value/mask pair of a rule
+func parseMark(t *testing.T, m string) (uint32, uint32) {
+	var value, mask uint32
+	_, err := fmt.Sscanf(m, "0x%x/0x%x", &value, &mask)
+	if err != nil {
+		t.Fatalf("mark %s: %s", m, err)
+	}
+	return value, mask
+}
+
+// parseHex parses a 0x prefixed value of a rule
+func parseHex(t *testing.T, v string) uint32 {
+	n, err := strconv.ParseUint(strings.TrimPrefix(v, "0x"), 16, 32)
+	if err != nil {
+		t.Fatalf("value %s: %s", v, err)
+	}
+	return uint32(n)
+}
+
+func TestHashBlockMarks(t *testing.T) {
+	tests := []struct {
+		name string
+		dest []string
+	}{
+		{name: "one destination", dest: []string{"10.0.1.2:80"}},
+		{name: "two destinations", dest: []string{"10.0.1.2:80", "10.0.1.3:80"}},
+		{name: "three destinations", dest: []string{"10.0.1.2:80", "10.0.1.3:80", "10.0.1.4:80"}},
+		{name: "seven destinations", dest: []string{"10.0.1.2:80", "10.0.1.3:80", "10.0.1.4:80", "10.0.1.5:80", "10.0.1.6:80", "10.0.1.7:80", "10.0.1.8:80"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			owners := make([]int, HashBuckets)
+			for b := range owners {
+				owners[b] = hashOwner(tt.dest, b)
+			}
+			blocks := hashBlocks(owners, 0, HashBuckets)
+
+			for _, j := range blocks {
+				value, mask := parseMark(t, j.mark())
+				if value&^HashMarkMask != 0 || mask&^HashMarkMask != 0 {
+					t.Errorf("mark %s of block %+v has bits outside 0x%x", j.mark(), j, HashMarkMask)
+				}
+				if mask&HashMarkOffset == 0 {
+					t.Errorf("mark %s of block %+v matches unmarked packets", j.mark(), j)
+				}
+			}
+
+			// Every bucket is matched by one block of its owner, whatever the other mark bits are
+			for b := 0; b < HashBuckets; b++ {
+				for _, other := range []uint32{0, 0x4000, 0x8000, 0xffff0000, 0xffffdfc0} {
+					packet := other | uint32(HashMarkOffset+b)
+					var matched []hashBlock
+					for _, j := range blocks {
+						value, mask := parseMark(t, j.mark())
+						if packet&mask == value {
+							matched = append(matched, j)
+						}
+					}
+					if len(matched) != 1 || matched[0].owner != owners[b] {
+						t.Errorf("mark 0x%x matches blocks %+v, expected one block of owner %d", packet, matched, owners[b])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestHashMarkRules(t *testing.T) {
+	tests := []struct {
+		name       string
+		nfmark     uint32
+		ctmark     uint32
+		bucket     int
+		wantNfmark uint32
+		wantCtmark uint32
+	}{
+		{
+			name:       "unmarked packet",
+			bucket:     5,
+			wantNfmark: HashMarkOffset + 5,
+		},
+		{
+			name:       "kube-proxy mark",
+			nfmark:     0x4000,
+			bucket:     63,
+			wantNfmark: 0x4000 | (HashMarkOffset + 63),
+		},
+		{
+			name:       "calico and kube-proxy marks",
+			nfmark:     0xabcd8000,
+			bucket:     0,
+			wantNfmark: 0xabcd8000 | HashMarkOffset,
+		},
+		{
+			name:       "reserved bits are replaced",
+			nfmark:     0x4000 | HashMarkMask,
+			bucket:     7,
+			wantNfmark: 0x4000 | (HashMarkOffset + 7),
+		},
+		{
+			name:       "reserved bits of the connection mark are kept",
+			ctmark:     0x2001,
+			bucket:     7,
+			wantNfmark: HashMarkOffset + 7,
+			wantCtmark: 0x2001,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOperator()
+			o.Opts.LBMode = "hash"
+
+			nfmark, ctmark := tt.nfmark, tt.ctmark
+			for _, r := range o.GetHashMarkRules() {
+				if _, p, ok := o.ruleTag(r); !ok || p != o.Opts.Profile {
+					t.Fatalf("rule %q is not tagged with the profile", r)
+				}
+
+				switch ruleArg(r, "-j") {
+				case "HMARK":
+					nfmark = parseHex(t, ruleArg(r, "--hmark-offset")) + uint32(tt.bucket)
+				case "CONNMARK":
+					if ruleArg(r, "--set-xmark") != "" {
+						value, mask := parseMark(t, ruleArg(r, "--set-xmark"))
+						ctmark = (ctmark &^ mask) ^ value
+						continue
+					}
+
+					nfmask, ctmask := parseHex(t, ruleArg(r, "--nfmask")), parseHex(t, ruleArg(r, "--ctmask"))
+					switch {
+					case strings.Contains(strings.Join(r, " "), "--save-mark"):
+						ctmark = (ctmark &^ ctmask) ^ (nfmark & nfmask)
+					case strings.Contains(strings.Join(r, " "), "--restore-mark"):
+						nfmark = (nfmark &^ nfmask) ^ (ctmark & ctmask)
+					default:
+						t.Fatalf("unexpected CONNMARK rule %q", r)
+					}
+				default:
+					t.Fatalf("unexpected rule %q", r)
+				}
+			}
+
+			if nfmark != tt.wantNfmark {
+				t.Errorf("packet mark is 0x%x, expected 0x%x", nfmark, tt.wantNfmark)
+			}
+			if ctmark != tt.wantCtmark {
+				t.Errorf("connection mark is 0x%x, expected 0x%x", ctmark, tt.wantCtmark)
+			}
+		})
+	}
+}
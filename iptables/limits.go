@@ -0,0 +1,213 @@
+package iptables
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/ulfox/iptlb/utils"
+)
+
+// hasLimits returns true if the profile has a rate or a connection limit
+func (o *Operator) hasLimits() bool {
+	return o.Opts.RateLimit != "" || o.Opts.MaxConnsPerDest > 0
+}
+
+// hasFilterRules returns true if the profile needs the custom filter chain:
+// for its limits or for rejecting the connections that no destination took
+func (o *Operator) hasFilterRules() bool {
+	return o.hasLimits() || o.Opts.Fallback == "reject"
+}
+
+// limitFilterChains returns the filter chains where the connections to the
+// profile's source pass after the nat decision: OUTPUT for the client backend,
+// FORWARD for the proxy backend and INPUT/FORWARD for the server backend
+func (o *Operator) limitFilterChains() []string {
+	switch o.Opts.RulesType {
+	case "client":
+		return []string{"OUTPUT"}
+	case "server":
+		return []string{"INPUT", "FORWARD"}
+	}
+	return []string{"FORWARD"}
+}
+
+// limitMatch returns the match of new connections that were sent to the
+// profile's source, before or after DNAT
+func (o *Operator) limitMatch() []string {
+	return []string{
+		"-p",
+		o.Opts.Protocol,
+		"-m",
+		"conntrack",
+		"--ctstate",
+		"NEW",
+		"--ctorigdst",
+		strings.Split(o.Opts.Src, ":")[0],
+		"--ctorigdstport",
+		strings.Split(o.Opts.Src, ":")[1],
+	}
+}
+
+// limitTarget returns the target for connections that exceed a limit
+func (o *Operator) limitTarget() []string {
+	if o.Opts.LimitAction != "reject" {
+		return []string{"-j", "DROP"}
+	}
+	return o.rejectTarget()
+}
+
+// rejectTarget returns the REJECT target. TCP clients get a reset
+func (o *Operator) rejectTarget() []string {
+	if o.Opts.Protocol == "tcp" {
+		return []string{"-j", "REJECT", "--reject-with", "tcp-reset"}
+	}
+	return []string{"-j", "REJECT"}
+}
+
+// hashlimitName returns the name of the profile's hashlimit table. Names
+// are limited to 15 characters, so the profile name is hashed. Hashlimit tables
+// are shared by the whole network namespace, so the chain prefix is hashed too
+// and profiles of the same name in two iptlb instances get separate tables
+func (o *Operator) hashlimitName() string {
+	h := fnv.New32a()
+	h.Write([]byte(o.tagPrefix() + o.Opts.Profile))
+	return fmt.Sprintf("iptlb_%08x", h.Sum32())
+}
+
+// GetLimitJumpRules method returns the rules that send new connections to the
+// profile's source to the custom filter chain t. Like GetCustomNatJumpRules, a rule
+// is created for each allowed client cidr and matches the profile's interfaces
+func (o *Operator) GetLimitJumpRules(t string) [][]string {
+	allow, _ := utils.SplitClientCIDRs(o.Opts.ClientCIDR)
+	if len(allow) == 0 {
+		allow = []string{""}
+	}
+
+	rules := make([][]string, 0, len(allow))
+	for _, c := range allow {
+		rule := append(o.limitMatch(), o.interfaceMatch()...)
+		if c != "" {
+			rule = append(rule, "-s", c)
+		}
+		rules = append(rules, o.tag(append(rule, "-j", t), RoleLimitJump, ""))
+	}
+
+	return rules
+}
+
+// limitRules returns the rules of the custom filter chain:
+// - the denied client cidrs, which are not balanced and therefore not limited
+// - the rate limit of new connections (per client or global) with hashlimit
+// - connections that were not DNATed because every destination reached
+// operator.Opts.MaxConnsPerDest (see withConnLimit) or because the profile
+// has no destinations. With -fallback=reject they are rejected, otherwise they
+// are dropped or rejected according to operator.Opts.LimitAction
+func (o *Operator) limitRules() [][]string {
+	var rules [][]string
+
+	_, deny := utils.SplitClientCIDRs(o.Opts.ClientCIDR)
+	for _, c := range deny {
+		rules = append(rules, o.tag(GetClientDenyRule(c), RoleDeny, c))
+	}
+
+	if o.Opts.RateLimit != "" {
+		rule := append(
+			o.limitMatch(),
+			"-m",
+			"hashlimit",
+			"--hashlimit-above",
+			o.Opts.RateLimit,
+		)
+		if o.Opts.RateLimitBurst > 0 {
+			rule = append(rule, "--hashlimit-burst", fmt.Sprintf("%d", o.Opts.RateLimitBurst))
+		}
+		if o.Opts.RateLimitKey != "global" {
+			rule = append(rule, "--hashlimit-mode", "srcip")
+		}
+		rule = append(rule, "--hashlimit-name", o.hashlimitName())
+		rules = append(rules, o.tag(append(rule, o.limitTarget()...), RoleRateLimit, ""))
+	}
+
+	if o.Opts.MaxConnsPerDest > 0 || o.Opts.Fallback == "reject" {
+		rule := append(
+			o.limitMatch(),
+			"-m",
+			"conntrack",
+			"!",
+			"--ctstate",
+			"DNAT",
+		)
+		if o.Opts.Fallback == "reject" {
+			rules = append(rules, o.tag(append(rule, o.rejectTarget()...), RoleOverflow, ""))
+		} else {
+			rules = append(rules, o.tag(append(rule, o.limitTarget()...), RoleOverflow, ""))
+		}
+	}
+
+	return append(rules, o.tag([]string{"-j", "RETURN"}, RoleReturn, ""))
+}
+
+// withConnLimit adds the connlimit match of operator.Opts.MaxConnsPerDest to a LB rule,
+// so the rule stops matching once its destination has that many connections.
+// Connections that find every destination full are not DNATed and are handled by limitRules
+func (o *Operator) withConnLimit(r []string) []string {
+	if o.Opts.MaxConnsPerDest <= 0 {
+		return r
+	}
+
+	return insertMatch(
+		r,
+		"-m",
+		"connlimit",
+		"--connlimit-upto",
+		fmt.Sprintf("%d", o.Opts.MaxConnsPerDest),
+		"--connlimit-mask",
+		"0",
+	)
+}
+
+// LimitRules for creating (t=true) or removing the profile's custom filter chain
+// with the rate & connection limits and the fallback reject, and the jump rules that lead to it
+func (o *Operator) LimitRules(t bool) error {
+	chain := o.GetChainName("filter")
+
+	if t {
+		err := o.Target("filter", chain).ensureChain()
+		if err != nil {
+			return err
+		}
+		// The chain is replaced as a whole, so rules of an older rate or
+		// connection limit do not stay in front of the new ones
+		err = o.syncChain(o.limitRules())
+		if err != nil {
+			return err
+		}
+		for _, c := range o.limitFilterChains() {
+			for _, r := range o.GetLimitJumpRules(chain) {
+				err = o.Target("filter", c).InsertRule(1, r)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	exists, err := o.iptChainExists("filter", chain)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+
+	for _, c := range o.limitFilterChains() {
+		err = o.Target("filter", c).removeJumpRules(chain)
+		if err != nil {
+			return err
+		}
+	}
+
+	return o.Target("filter", chain).DeleteChain()
+}
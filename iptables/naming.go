@@ -0,0 +1,181 @@
+package iptables
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+
+	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+const (
+	// DefaultPrefix is the chain prefix of a state without a header
+	DefaultPrefix = "IPTLB"
+
+	// ChainNameMaxLen is the longest chain name of a profile. It keeps <PREFIX>_FILTER_<name>
+	// under the 28 character limit of iptables chain names and, with the default prefix,
+	// the <chain>:ACCEPT: prefix of the chain LOG rule under the 29 character limit of
+	// --log-prefix. Longer log prefixes are shortened (see shortLogPrefix)
+	ChainNameMaxLen = 11
+
+	// LogPrefixMaxLen is the kernel limit of the LOG --log-prefix
+	LogPrefixMaxLen = 29
+)
+
+// legacyChainName returns the upper-cased profile name with - replaced by _,
+// which is the chain name of profiles that do not store one
+func legacyChainName(p string) string {
+	return strings.Replace(strings.ToUpper(p), "-", "_", -1)
+}
+
+// hashedChainName returns the shortened chain name of profile p: the start of
+// its legacy name and a hash of the profile name, which tells apart profiles
+// like my-app and my_app
+func hashedChainName(p string) string {
+	h := fnv.New32a()
+	h.Write([]byte(p))
+
+	name := legacyChainName(p)
+	if len(name) > ChainNameMaxLen-5 {
+		name = name[:ChainNameMaxLen-5]
+	}
+
+	return fmt.Sprintf("%s_%04X", name, h.Sum32()&0xffff)
+}
+
+// loadPrefix sets operator.Opts.Prefix to the chain prefix of the state header,
+// or DefaultPrefix if the state has none. A different operator.Opts.Prefix is
+// written to the header, as long as the state has no profiles that were created
+// with the old prefix
+func (o *Operator) loadPrefix() error {
+	stored := o.Storage.GetPrefix()
+	if stored == "" {
+		stored = DefaultPrefix
+	}
+	if o.Opts.Prefix == "" || o.Opts.Prefix == stored {
+		o.Opts.Prefix = stored
+		return nil
+	}
+
+	err := utils.CheckPrefix(o.Opts.Prefix)
+	if err != nil {
+		return err
+	}
+
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return err
+	}
+	if len(profiles) > 0 {
+		return fmt.Errorf(ipte.ErrPrefixChange, o.Opts.Path, stored, o.Opts.Prefix)
+	}
+
+	return o.Storage.SetPrefix(o.Opts.Prefix)
+}
+
+// chainPrefix returns the prefix of every chain of the iptlb instance, e.g. IPTLB_
+func (o *Operator) chainPrefix() string {
+	return o.Opts.Prefix + "_"
+}
+
+// logPrefix returns the prefix of the LOG rules that the iptlb instance adds to
+// the jump chains, e.g. IPTLB:
+func (o *Operator) logPrefix() string {
+	return o.Opts.Prefix + ":"
+}
+
+// tagPrefix returns the prefix of the comment that tags the rules of the iptlb
+// instance, e.g. iptlb:
+func (o *Operator) tagPrefix() string {
+	return strings.ToLower(o.Opts.Prefix) + ":"
+}
+
+// shortLogPrefix shortens a LOG --log-prefix to the kernel limit
+func shortLogPrefix(p string) string {
+	if len(p) > LogPrefixMaxLen {
+		return p[:LogPrefixMaxLen]
+	}
+	return p
+}
+
+// stateChainName returns the chain name of profile p in the state
+func (o *Operator) stateChainName(p string) string {
+	name, err := o.Storage.GetPath(fmt.Sprintf("%s.chainName", p))
+	if err == nil {
+		if v, ok := name.(string); ok && v != "" {
+			return v
+		}
+	}
+
+	return legacyChainName(p)
+}
+
+// newChainName returns the chain name for operator.Opts.Profile. A profile in the
+// state keeps its chain name. Otherwise the upper-cased profile name is used if it
+// fits in ChainNameMaxLen and no other profile uses it, or else the hashed name.
+// The custom chains of a new profile must not exist in its network namespace
+func (o *Operator) newChainName() (string, error) {
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return "", err
+	}
+
+	taken := make(map[string]string)
+	for _, p := range profiles {
+		if p == o.Opts.Profile {
+			return o.stateChainName(p), nil
+		}
+		taken[o.stateChainName(p)] = p
+	}
+
+	var candidates []string
+	if legacy := legacyChainName(o.Opts.Profile); len(legacy) <= ChainNameMaxLen {
+		candidates = append(candidates, legacy)
+	}
+	candidates = append(candidates, hashedChainName(o.Opts.Profile))
+
+	var name string
+	for _, c := range candidates {
+		if _, ok := taken[c]; !ok {
+			name = c
+			break
+		}
+	}
+	if name == "" {
+		return "", fmt.Errorf(
+			"chain name [%s] of profile [%s] is used by profile [%s]. Choose another profile name",
+			candidates[len(candidates)-1],
+			o.Opts.Profile,
+			taken[candidates[len(candidates)-1]],
+		)
+	}
+
+	if !o.Opts.CreateRules {
+		return name, nil
+	}
+
+	err = o.SetNetns()
+	if err != nil {
+		return "", err
+	}
+
+	for _, t := range []string{"nat", "filter"} {
+		chain := fmt.Sprintf("%s%s_%s", o.chainPrefix(), strings.ToUpper(t), name)
+		chainExists, err := o.iptChainExists(t, chain)
+		if err != nil {
+			return "", err
+		}
+		if chainExists {
+			return "", fmt.Errorf(
+				"chain [%s] of profile [%s] already exists in table [%s] and no profile owns it. "+
+					"Remove it with iptlb gc -orphans or choose another profile name",
+				chain,
+				o.Opts.Profile,
+				t,
+			)
+		}
+	}
+
+	return name, nil
+}
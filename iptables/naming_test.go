@@ -0,0 +1,121 @@
+package iptables
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ulfox/iptlb/state"
+)
+
+func TestHashedChainName(t *testing.T) {
+	tests := []struct {
+		profile, prefix string
+	}{
+		{profile: "web", prefix: "WEB_"},
+		{profile: "my-app", prefix: "MY_APP_"},
+		{profile: "a-very-long-profile-name", prefix: "A_VERY_"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.profile, func(t *testing.T) {
+			name := hashedChainName(tt.profile)
+			if len(name) > ChainNameMaxLen {
+				t.Errorf("%s has %d characters, expected at most %d", name, len(name), ChainNameMaxLen)
+			}
+			if !strings.HasPrefix(name, tt.prefix) {
+				t.Errorf("%s does not start with %s", name, tt.prefix)
+			}
+			if name != hashedChainName(tt.profile) {
+				t.Errorf("%s is not stable", name)
+			}
+		})
+	}
+
+	// Profiles with the same legacy name get different hashed names
+	if hashedChainName("my-app") == hashedChainName("my_app") {
+		t.Errorf("my-app and my_app share the chain name %s", hashedChainName("my-app"))
+	}
+}
+
+func TestNewChainName(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile string
+		stored  map[string]string
+		want    string
+		err     bool
+	}{
+		{
+			name:    "short name",
+			profile: "web",
+			want:    "WEB",
+		},
+		{
+			name:    "name of 11 characters",
+			profile: "abcdefghijk",
+			want:    "ABCDEFGHIJK",
+		},
+		{
+			name:    "long name",
+			profile: "abcdefghijkl",
+			want:    hashedChainName("abcdefghijkl"),
+		},
+		{
+			name:    "legacy name taken",
+			profile: "my-app",
+			stored:  map[string]string{"my_app": "MY_APP"},
+			want:    hashedChainName("my-app"),
+		},
+		{
+			name:    "stored profile keeps its name",
+			profile: "web",
+			stored:  map[string]string{"web": "WEB_1234"},
+			want:    "WEB_1234",
+		},
+		{
+			name:    "profile without a stored name",
+			profile: "web",
+			stored:  map[string]string{"web": ""},
+			want:    "WEB",
+		},
+		{
+			name:    "every name taken",
+			profile: "my-app",
+			stored:  map[string]string{"my_app": "MY_APP", "other": hashedChainName("my-app")},
+			err:     true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := state.NewStateFactory(filepath.Join(t.TempDir(), "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for p, c := range tt.stored {
+				if err := db.AddChainName(p, c); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			o := testOperator()
+			o.Storage = db
+			o.Opts.Profile = tt.profile
+
+			name, err := o.newChainName()
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got chain name %s", name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if name != tt.want {
+				t.Errorf("chain name is %s, expected %s", name, tt.want)
+			}
+		})
+	}
+}
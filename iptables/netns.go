@@ -0,0 +1,90 @@
+package iptables
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/utils"
+	"github.com/vishvananda/netns"
+)
+
+// SetNetns method switches the calling thread to the network namespace of
+// operator.Opts.Netns, or back to the namespace iptlb was started in when
+// operator.Opts.Netns is empty. Every iptables, iptables-restore and netlink
+// call made afterwards by this thread, including the processes it starts,
+// operates on that namespace.
+// The calling goroutine must be locked to its thread (see runtime.LockOSThread)
+func (o *Operator) SetNetns() error {
+	if o.Opts.Netns == "" {
+		return netns.Set(o.netns)
+	}
+
+	ns, err := netns.GetFromPath(o.Opts.Netns)
+	if err != nil {
+		return fmt.Errorf("netns [%s]: %s", o.Opts.Netns, err)
+	}
+	defer ns.Close()
+
+	err = netns.Set(ns)
+	if err != nil {
+		return fmt.Errorf("netns [%s]: %s", o.Opts.Netns, err)
+	}
+
+	o.Logger.WithFields(logrus.Fields{
+		"Stage":   "SetNetns",
+		"Profile": o.Opts.Profile,
+		"Netns":   o.Opts.Netns,
+	}).Debug("Switched network namespace")
+
+	return nil
+}
+
+// pinNetns pins the network namespace of operator.Opts.NetnsPID (see utils.PinNetns)
+// and points operator.Opts.Netns to the pinned path, so the profile keeps its namespace
+// after the process exits. Only profiles applied with -run are pinned. The returned
+// value reports if operator.Opts.Netns was pinned
+func (o *Operator) pinNetns() (bool, error) {
+	if o.Opts.NetnsPID == 0 || !o.Opts.CreateRules || utils.IsPinnedNetns(o.Opts.Netns) {
+		return false, nil
+	}
+
+	path, err := utils.PinNetns(o.Opts.NetnsPID)
+	if err != nil {
+		return false, err
+	}
+	o.Opts.Netns = path
+
+	o.Logger.WithFields(logrus.Fields{
+		"Stage":   "pinNetns",
+		"Profile": o.Opts.Profile,
+		"Netns":   path,
+	}).Debug("Pinned network namespace")
+
+	return true, nil
+}
+
+// releaseNetns unpins network namespace ns of a deleted profile when it was pinned
+// for -netns-pid (see utils.PinNetns) and no other profile of the state uses it
+func (o *Operator) releaseNetns(ns string) error {
+	if !utils.IsPinnedNetns(ns) {
+		return nil
+	}
+
+	inUse, err := o.Storage.NetnsInUse(ns)
+	if err != nil || inUse {
+		return err
+	}
+
+	err = utils.UnpinNetns(ns)
+	if err != nil {
+		return err
+	}
+
+	o.Logger.WithFields(logrus.Fields{
+		"Stage":   "releaseNetns",
+		"Profile": o.Opts.Profile,
+		"Netns":   ns,
+	}).Debug("Unpinned network namespace")
+
+	return nil
+}
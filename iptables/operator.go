@@ -2,13 +2,17 @@ package iptables
 
 import (
 	"fmt"
+	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/sirupsen/logrus"
 	"github.com/ulfox/iptlb/state"
+	"github.com/ulfox/iptlb/utils"
 	ipte "github.com/ulfox/iptlb/utils/logs"
+	"github.com/vishvananda/netns"
 )
 
 type checkInput = func(src string, dest []string) error
@@ -19,19 +23,39 @@ type Operator struct {
 	IPT     *iptables.IPTables
 	Opts    *OperatorOpts
 	Logger  *logrus.Logger
+	Changes state.RuleChanges
+	netns   netns.NsHandle
+	pending *pendingBackup
+	batch   *restoreBatch
+	root    string
+	kept    []interface{}
 	Cache   struct {
 		Src, RulesType, Protocol, LogLevel, Profile, Chain, Table string
-		Dest                                                      []string
-		ChainLogging                                              bool
+		InInterface, OutInterface, Netns, LBMode                  string
+		RateLimit, RateLimitKey, LimitAction                      string
+		FallbackDest, Fallback, ExpiresAt                         string
+		RateLimitBurst, MaxConnsPerDest                           int
+		Dest, BackupDest, ClientCIDR                              []string
+		ChainLogging, HashPort                                    bool
+		Labels                                                    map[string]string
 	}
 }
 
 // OperatorOpts is a struct used by iptlb.Operator to configure iptables
 type OperatorOpts struct {
 	Src, RulesType, Path, Profile, Protocol, LogLevel, Table, Chain string
-	Dest, RuleArgs                                                  []string
-	Delete, Reset, ChainLogging, CreateRules, UseState              bool
+	InInterface, OutInterface, Netns, LBMode                        string
+	RateLimit, RateLimitKey, LimitAction                            string
+	FallbackDest, Fallback, Selector, ExpiresAt, ChainName, Prefix  string
+	RateLimitBurst, MaxConnsPerDest, ActiveTier, BackupRetention    int
+	Revisions, NetnsPID                                             int
+	Dest, BackupDest, RuleArgs, ClientCIDR                          []string
+	Delete, Reset, ChainLogging, CreateRules, UseState, Enabled     bool
+	Drain, DrainForce, Preflight, HashPort                          bool
+	DrainGrace, HealthTimeout, TTL                                  time.Duration
+	Labels                                                          map[string]string
 	CheckInput                                                      checkInput
+	Report                                                          *Report
 }
 
 // NewOperatorFactory creates a new iptlb.Operator
@@ -46,18 +70,30 @@ func NewOperatorFactory(o *OperatorOpts, l *logrus.Logger) (*Operator, error) {
 		return nil, err
 	}
 
+	// The namespace iptlb was started in. Profiles without a netns are applied here
+	origNetns, err := netns.Get()
+	if err != nil {
+		return nil, err
+	}
+
 	state := &Operator{
 		Storage: db,
 		Opts:    o,
 		IPT:     ipt,
 		Logger:  l,
+		netns:   origNetns,
+	}
+
+	err = state.loadPrefix()
+	if err != nil {
+		return nil, err
 	}
 
 	return state, nil
 }
 
 // Target method to allow chain method usage.
-// For example operator.Target("someTable", "someChain").CreateChain()
+// For example operator.Target("someTable", "someChain").RuleExists(r)
 func (o *Operator) Target(t, c string) *Operator {
 	o.Opts.Table = t
 	o.Opts.Chain = c
@@ -69,6 +105,22 @@ func (o *Operator) copyToCache() {
 	o.Cache.Src = o.Opts.Src
 	o.Cache.RulesType = o.Opts.RulesType
 	o.Cache.Dest = o.Opts.Dest
+	o.Cache.BackupDest = o.Opts.BackupDest
+	o.Cache.Labels = o.Opts.Labels
+	o.Cache.ExpiresAt = o.Opts.ExpiresAt
+	o.Cache.ClientCIDR = o.Opts.ClientCIDR
+	o.Cache.InInterface = o.Opts.InInterface
+	o.Cache.OutInterface = o.Opts.OutInterface
+	o.Cache.Netns = o.Opts.Netns
+	o.Cache.LBMode = o.Opts.LBMode
+	o.Cache.HashPort = o.Opts.HashPort
+	o.Cache.RateLimit = o.Opts.RateLimit
+	o.Cache.RateLimitKey = o.Opts.RateLimitKey
+	o.Cache.RateLimitBurst = o.Opts.RateLimitBurst
+	o.Cache.MaxConnsPerDest = o.Opts.MaxConnsPerDest
+	o.Cache.LimitAction = o.Opts.LimitAction
+	o.Cache.FallbackDest = o.Opts.FallbackDest
+	o.Cache.Fallback = o.Opts.Fallback
 	o.Cache.Protocol = o.Opts.Protocol
 	o.Cache.LogLevel = o.Opts.LogLevel
 	o.Cache.Profile = o.Opts.Profile
@@ -81,6 +133,22 @@ func (o *Operator) copyFromCache() {
 	o.Opts.Src = o.Cache.Src
 	o.Opts.RulesType = o.Cache.RulesType
 	o.Opts.Dest = o.Cache.Dest
+	o.Opts.BackupDest = o.Cache.BackupDest
+	o.Opts.Labels = o.Cache.Labels
+	o.Opts.ExpiresAt = o.Cache.ExpiresAt
+	o.Opts.ClientCIDR = o.Cache.ClientCIDR
+	o.Opts.InInterface = o.Cache.InInterface
+	o.Opts.OutInterface = o.Cache.OutInterface
+	o.Opts.Netns = o.Cache.Netns
+	o.Opts.LBMode = o.Cache.LBMode
+	o.Opts.HashPort = o.Cache.HashPort
+	o.Opts.RateLimit = o.Cache.RateLimit
+	o.Opts.RateLimitKey = o.Cache.RateLimitKey
+	o.Opts.RateLimitBurst = o.Cache.RateLimitBurst
+	o.Opts.MaxConnsPerDest = o.Cache.MaxConnsPerDest
+	o.Opts.LimitAction = o.Cache.LimitAction
+	o.Opts.FallbackDest = o.Cache.FallbackDest
+	o.Opts.Fallback = o.Cache.Fallback
 	o.Opts.Protocol = o.Cache.Protocol
 	o.Opts.LogLevel = o.Cache.LogLevel
 	o.Opts.Profile = o.Cache.Profile
@@ -92,6 +160,87 @@ func (o *Operator) copyFromCache() {
 // Configure is the main function that runs after we initiate operator.
 // It checks the inputs and decides if it will create/delete/reset a profie
 func (o *Operator) Configure() error {
+	return o.audit(o.action(), o.configure)
+}
+
+// audit runs f and records the change it made to operator.Opts.Profile
+// in the audit log next to the state file and in operator.Opts.Report
+func (o *Operator) audit(action string, f func() error) error {
+	profile := o.Opts.Profile
+	entry := state.NewAuditEntry(profile, action)
+
+	// Actions on the whole state, like purge, have no profile
+	if profile != "" {
+		before, err := o.Storage.GetProfile(profile)
+		if err != nil {
+			return err
+		}
+		entry.Before = before
+	}
+
+	// The tables are backed up right before f changes iptables for the first time
+	err := o.prepareBackup(action, profile)
+	if err != nil {
+		return err
+	}
+
+	o.Changes = state.RuleChanges{}
+	fErr := f()
+	o.pending = nil
+
+	// A batched replay records the action once the batch is committed
+	if o.batch != nil {
+		o.batch.audits = append(o.batch.audits, batchAudit{action: action, entry: entry, changes: o.Changes, err: fErr})
+		return fErr
+	}
+
+	err = o.recordAudit(action, entry, o.Changes, fErr)
+	if err != nil && fErr == nil {
+		return err
+	}
+
+	return fErr
+}
+
+// recordAudit completes entry of action with changes, the error fErr of the action
+// and the state of its profile after the action, and records it in the audit log
+// and in operator.Opts.Report
+func (o *Operator) recordAudit(action string, entry *state.AuditEntry, changes state.RuleChanges, fErr error) error {
+	if fErr != nil {
+		entry.Error = fErr.Error()
+	}
+	entry.RuleChanges = changes
+
+	if entry.Profile != "" {
+		after, err := o.Storage.GetProfile(entry.Profile)
+		if err != nil {
+			return err
+		}
+		entry.After = after
+	}
+
+	if o.Opts.Report != nil {
+		o.Opts.Report.Add(newResult(entry.Profile, action, changes, entry.Before, entry.After, fErr))
+	}
+
+	return state.AppendAudit(state.AuditPath(o.Opts.Path), entry)
+}
+
+// action returns the name under which the current invocation is recorded
+// in the audit log
+func (o *Operator) action() string {
+	switch {
+	case o.Opts.Delete:
+		return "delete"
+	case o.Opts.Reset:
+		return "reset"
+	case o.Opts.UseState:
+		return "apply"
+	}
+	return "add"
+}
+
+func (o *Operator) configure() error {
 	log := o.Logger.WithFields(logrus.Fields{
 		"Component": "Operator",
 		"Stage":     "Configure",
@@ -102,20 +251,106 @@ func (o *Operator) Configure() error {
 	}
 
 	if o.Opts.Delete {
-		log.Warnf(ipte.WarnDelete, o.Opts.Profile)
+		log.WithField("Profile", o.Opts.Profile).Warn(ipte.WarnDelete)
 		exists, err := o.ProfileExists()
 		if err != nil {
 			return err
 		}
 
-		if exists {
-			return o.DeleteProfile()
+		if !exists {
+			return nil
 		}
-		return nil
+
+		err = o.DeleteProfile()
+		if err != nil {
+			return err
+		}
+
+		if o.Opts.Drain && o.Opts.CreateRules {
+			err = o.DrainDestinations(append(append([]string{}, o.Opts.Dest...), o.Opts.BackupDest...))
+			if err != nil {
+				return err
+			}
+		}
+		return o.releaseNetns(o.Opts.Netns)
 	}
 
+	// Running the command that created a profile again applies the profile from the
+	// state, so an unchanged definition is not an error. A changed one still needs -reset
+	if !o.Opts.Reset && !o.Opts.UseState {
+		same, err := o.SameAsState()
+		if err != nil {
+			return err
+		}
+		if same {
+			log.WithField("Profile", o.Opts.Profile).Info(ipte.InfoProfileUnchanged)
+			o.Opts.UseState = true
+		}
+	}
+
+	err := o.Opts.CheckInput(o.Opts.Src, append(append([]string{}, o.Opts.Dest...), o.Opts.BackupDest...))
+	if err != nil {
+		return err
+	}
+	err = utils.CheckClientCIDRs(o.Opts.ClientCIDR)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckInterfaces(o.Opts.RulesType, o.Opts.InInterface, o.Opts.OutInterface)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckNetns(o.Opts.Netns)
+	if err != nil {
+		return err
+	}
+	// The host checks of CheckTargets and Preflight run in the profile's namespace
+	err = o.SetNetns()
+	if err != nil {
+		return err
+	}
+	err = o.CheckTargets()
+	if err != nil {
+		return err
+	}
+	if !o.Opts.UseState || o.Opts.Reset {
+		err = utils.CheckProfileName(o.Opts.Profile)
+		if err != nil {
+			return err
+		}
+	}
+	err = utils.CheckLBMode(o.Opts.LBMode)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckLimits(o.Opts.RateLimit, o.Opts.RateLimitKey, o.Opts.LimitAction, o.Opts.RateLimitBurst, o.Opts.MaxConnsPerDest)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckFallback(o.Opts.Fallback, o.Opts.FallbackDest)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckBackupDest(o.Opts.Protocol, o.Opts.BackupDest)
+	if err != nil {
+		return err
+	}
+	err = utils.CheckExpiresAt(o.Opts.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	if o.Opts.Preflight && o.Opts.CreateRules {
+		err = o.Preflight()
+		if err != nil {
+			return err
+		}
+	}
+	log.Info(ipte.InfoInputValidation)
+
+	// A reset deletes the profile only once the new version passed the checks,
+	// so a rollback to a revision that fails them keeps the profile and its history
 	if o.Opts.Reset {
-		log.Warnf(ipte.WarnReset, o.Opts.Profile)
+		log.WithField("Profile", o.Opts.Profile).Warn(ipte.WarnReset)
 		exists, err := o.ProfileExists()
 		if err != nil {
 			return err
@@ -123,7 +358,9 @@ func (o *Operator) Configure() error {
 
 		o.copyToCache()
 		if exists {
-			err := o.DeleteProfile()
+			// The revisions are kept for the new version of the profile
+			o.kept = o.Storage.GetRevisions(o.Opts.Profile)
+			err = o.DeleteProfile()
 			if err != nil {
 				return err
 			}
@@ -132,18 +369,98 @@ func (o *Operator) Configure() error {
 		o.copyFromCache()
 	}
 
-	err := o.Opts.CheckInput(o.Opts.Src, o.Opts.Dest)
+	// The chain name is picked once the profile of a reset is gone, so it can reuse its name
+	if !o.Opts.UseState || o.Opts.Reset {
+		o.Opts.ChainName, err = o.newChainName()
+		if err != nil {
+			return err
+		}
+	}
+
+	pinned, err := o.pinNetns()
 	if err != nil {
 		return err
 	}
-	log.Info(ipte.InfoInputValidation)
 
 	err = o.AddProfile()
+	if err != nil && pinned {
+		// The pin stays only if the state kept the profile in it
+		rErr := o.releaseNetns(o.Opts.Netns)
+		if rErr != nil {
+			log.WithError(rErr).Warn(ipte.WarnNetnsUnpin)
+		}
+	}
+
+	return err
+}
+
+// SameAsState method reports if operator.Opts defines operator.Opts.Profile exactly as
+// the state does (see sameExpiry for the expiration). When it does, operator.Opts is
+// left with the profile read from the state, otherwise operator.Opts is not changed
+func (o *Operator) SameAsState() (bool, error) {
+	exists, err := o.ProfileExists()
+	if err != nil || !exists {
+		return false, err
+	}
+
+	o.copyToCache()
+	err = o.GetState()
 	if err != nil {
-		return err
+		o.copyFromCache()
+		return false, err
 	}
 
-	return nil
+	c := o.Cache
+	same := c.Src == o.Opts.Src &&
+		c.RulesType == o.Opts.RulesType &&
+		c.Protocol == o.Opts.Protocol &&
+		c.LogLevel == o.Opts.LogLevel &&
+		c.ChainLogging == o.Opts.ChainLogging &&
+		c.InInterface == o.Opts.InInterface &&
+		c.OutInterface == o.Opts.OutInterface &&
+		(c.Netns == o.Opts.Netns || utils.SameNetns(c.Netns, o.Opts.Netns)) &&
+		c.LBMode == o.Opts.LBMode &&
+		c.HashPort == o.Opts.HashPort &&
+		c.RateLimit == o.Opts.RateLimit &&
+		c.RateLimitKey == o.Opts.RateLimitKey &&
+		c.RateLimitBurst == o.Opts.RateLimitBurst &&
+		c.MaxConnsPerDest == o.Opts.MaxConnsPerDest &&
+		c.LimitAction == o.Opts.LimitAction &&
+		c.Fallback == o.Opts.Fallback &&
+		c.FallbackDest == o.Opts.FallbackDest &&
+		o.sameExpiry(c.ExpiresAt) &&
+		sameStrings(c.Dest, o.Opts.Dest) &&
+		sameStrings(c.BackupDest, o.Opts.BackupDest) &&
+		sameStrings(c.ClientCIDR, o.Opts.ClientCIDR) &&
+		(len(c.Labels) == 0 && len(o.Opts.Labels) == 0 || reflect.DeepEqual(c.Labels, o.Opts.Labels))
+	if !same {
+		o.copyFromCache()
+	}
+
+	return same, nil
+}
+
+// sameExpiry reports if expiresAt, the expiration that operator.Opts defined, is the
+// one of the state in operator.Opts.ExpiresAt. An expiration from -ttl is computed
+// again on every run, so it matches any expiration of the state
+func (o *Operator) sameExpiry(expiresAt string) bool {
+	if o.Opts.TTL != 0 {
+		return o.Opts.ExpiresAt != ""
+	}
+	return expiresAt == o.Opts.ExpiresAt
+}
+
+// sameStrings reports if a and b hold the same strings in the same order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
 // ProfileExists method for checking if a given profile exists
@@ -158,44 +475,132 @@ func (o *Operator) ProfileExists() (bool, error) {
 	return true, nil
 }
 
-// GetChainName method used to generate the custom dnat chain name that is created
-// to host the nat loadbalancing rules
+// GetChainName method used to generate the custom chain name of table s that is created
+// to host the rules of the profile: <PREFIX>_<TABLE>_<operator.Opts.ChainName>. Profiles
+// written before the chain name was stored use the upper-cased profile name
 func (o *Operator) GetChainName(s string) string {
-	return strings.Replace(
-		fmt.Sprintf(
-			"IPTLB_%s_%s",
-			strings.ToUpper(s),
-			strings.ToUpper(o.Opts.Profile),
-		),
-		"-",
-		"_",
-		-1,
-	)
+	name := o.Opts.ChainName
+	if name == "" {
+		name = legacyChainName(o.Opts.Profile)
+	}
+
+	return fmt.Sprintf("%s%s_%s", o.chainPrefix(), strings.ToUpper(s), name)
 }
 
 // GetCustomNatJumpRule method for creating a jump rule to the custom dnat chain.
 // If backend is client, the jump rule is applied in the OUTPUT nat chain.
 // If backend is proxy, the jump rule is applied in the PREROUTING nat chain.
-// If backend is server, the jump rule is applied in the INPUT nat chain.
-func (o *Operator) GetCustomNatJumpRule(t string) []string {
-	if o.Opts.RulesType == "client" {
-		o.Target("nat", "OUTPUT")
-	} else if o.Opts.RulesType == "proxy" {
-		o.Target("nat", "PREROUTING")
-	} else if o.Opts.RulesType == "server" {
-		o.Target("nat", "INPUT")
+// If backend is server, the jump rule is applied in the PREROUTING nat chain and
+// only matches packets sent to a local address. The nat INPUT chain can not be
+// used since netfilter does not allow DNAT there.
+// If c is not empty, the rule only matches packets from client cidr c.
+// The rule matches operator.Opts.InInterface/OutInterface when they are set and is tagged with the profile
+func (o *Operator) GetCustomNatJumpRule(t, c string) []string {
+	o.Target("nat", o.natJumpChain())
+
+	return o.tag(o.natJumpRule(t, c), RoleJump, "")
+}
+
+// GetCustomNatLocalJumpRules returns the jump rules of the server backend in the
+// nat OUTPUT chain. Connections that the host opens to its own source address never
+// pass PREROUTING, they are captured here instead. A profile with -in-interface has
+// none, host traffic does not arrive on an interface
+func (o *Operator) GetCustomNatLocalJumpRules(t string) [][]string {
+	if o.Opts.RulesType != "server" || o.Opts.InInterface != "" {
+		return nil
 	}
+	o.Target("nat", "OUTPUT")
 
-	return []string{
+	allow, _ := utils.SplitClientCIDRs(o.Opts.ClientCIDR)
+	if len(allow) == 0 {
+		allow = []string{""}
+	}
+
+	rules := make([][]string, 0, len(allow))
+	for _, c := range allow {
+		rules = append(rules, o.tag(o.natJumpRule(t, c), RoleLocalJump, ""))
+	}
+
+	return rules
+}
+
+// natJumpRule returns the untagged jump rule to the custom dnat chain t for
+// client cidr c, see GetCustomNatJumpRule
+func (o *Operator) natJumpRule(t, c string) []string {
+	rule := []string{
 		"-p",
 		o.Opts.Protocol,
+	}
+	rule = append(rule, o.interfaceMatch()...)
+	if o.Opts.RulesType == "server" {
+		rule = append(rule, "-m", "addrtype", "--dst-type", "LOCAL")
+	}
+	if c != "" {
+		rule = append(rule, "-s", c)
+	}
+
+	return append(
+		rule,
 		"-d",
 		strings.Split(o.Opts.Src, ":")[0],
 		"--dport",
 		strings.Split(o.Opts.Src, ":")[1],
 		"-j",
 		t,
+	)
+}
+
+// natJumpChain returns the nat chain where the jump rules are applied
+func (o *Operator) natJumpChain() string {
+	if o.Opts.RulesType == "client" {
+		return "OUTPUT"
+	}
+	return "PREROUTING"
+}
+
+// jumpChains returns the nat chains that may hold jump rules to the custom
+// chain of the profile. Older versions applied the server backend jump rules
+// in the nat INPUT chain, so those are cleaned up too
+func (o *Operator) jumpChains() []string {
+	switch o.Opts.RulesType {
+	case "client":
+		return []string{"OUTPUT"}
+	case "server":
+		return []string{"PREROUTING", "OUTPUT", "INPUT"}
+	}
+	return []string{"PREROUTING"}
+}
+
+// interfaceMatch returns the -i/-o matches for operator.Opts.InInterface
+// and operator.Opts.OutInterface
+func (o *Operator) interfaceMatch() []string {
+	var match []string
+	if o.Opts.InInterface != "" {
+		match = append(match, "-i", o.Opts.InInterface)
+	}
+	if o.Opts.OutInterface != "" {
+		match = append(match, "-o", o.Opts.OutInterface)
+	}
+
+	return match
+}
+
+// GetCustomNatJumpRules method for creating the jump rules to the custom dnat chain.
+// A rule is created for each allowed client cidr of operator.Opts.ClientCIDR.
+// Without allowed client cidrs a single rule that matches any client is created.
+// Denied client cidrs are handled inside the custom chain (see GetClientDenyRule)
+func (o *Operator) GetCustomNatJumpRules(t string) [][]string {
+	allow, _ := utils.SplitClientCIDRs(o.Opts.ClientCIDR)
+	if len(allow) == 0 {
+		return [][]string{o.GetCustomNatJumpRule(t, "")}
 	}
+
+	rules := make([][]string, 0, len(allow))
+	for _, c := range allow {
+		rules = append(rules, o.GetCustomNatJumpRule(t, c))
+	}
+
+	return rules
 }
 
 // CheckIPV4 simple method for checking if a socket addres is a correct
@@ -220,7 +625,8 @@ func (o *Operator) CheckIPV4(ip string) error {
 // the NATLBRules and InsertRule Methods that apply the LB logic
 func (o *Operator) AddProfile() error {
 	log := o.Logger.WithFields(logrus.Fields{
-		"Stage": "AddProfile",
+		"Stage":   "AddProfile",
+		"Profile": o.Opts.Profile,
 	})
 
 	err := o.CheckIPV4(o.Opts.Src)
@@ -231,11 +637,15 @@ func (o *Operator) AddProfile() error {
 	if o.Opts.UseState && !o.Opts.Reset {
 		goto addProfileAfterDBSync
 	}
-	err = o.Storage.AddSource(o.Opts.Profile, o.Opts.Src)
+	err = o.Storage.AddSource(o.Opts.Profile, o.Opts.Src, state.SourceMatch{
+		InInterface:  o.Opts.InInterface,
+		OutInterface: o.Opts.OutInterface,
+		Netns:        o.Opts.Netns,
+	})
 	if err != nil {
 		return err
 	}
-	for _, j := range o.Opts.Dest {
+	for _, j := range append(append([]string{}, o.Opts.Dest...), o.Opts.BackupDest...) {
 		err = o.CheckIPV4(j)
 		if err != nil {
 			return err
@@ -245,6 +655,10 @@ func (o *Operator) AddProfile() error {
 	if err != nil {
 		return err
 	}
+	err = o.Storage.AddBackupDestinations(o.Opts.Profile, o.Opts.BackupDest)
+	if err != nil {
+		return err
+	}
 	err = o.Storage.AddProtocol(o.Opts.Profile, o.Opts.Protocol)
 	if err != nil {
 		return err
@@ -261,37 +675,149 @@ func (o *Operator) AddProfile() error {
 	if err != nil {
 		return err
 	}
+	err = o.Storage.AddClientCIDR(o.Opts.Profile, o.Opts.ClientCIDR)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddInterfaces(o.Opts.Profile, o.Opts.InInterface, o.Opts.OutInterface)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddNetns(o.Opts.Profile, o.Opts.Netns)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddLBMode(o.Opts.Profile, o.Opts.LBMode, o.Opts.HashPort)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddLimits(o.Opts.Profile, state.Limits{
+		RateLimit:       o.Opts.RateLimit,
+		RateLimitKey:    o.Opts.RateLimitKey,
+		RateLimitBurst:  o.Opts.RateLimitBurst,
+		MaxConnsPerDest: o.Opts.MaxConnsPerDest,
+		LimitAction:     o.Opts.LimitAction,
+	})
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddFallback(o.Opts.Profile, o.Opts.Fallback, o.Opts.FallbackDest)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddEnabled(o.Opts.Profile, true)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddLabels(o.Opts.Profile, o.Opts.Labels)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddExpiresAt(o.Opts.Profile, o.Opts.ExpiresAt)
+	if err != nil {
+		return err
+	}
+	err = o.Storage.AddChainName(o.Opts.Profile, o.Opts.ChainName)
+	if err != nil {
+		return err
+	}
+	err = o.addRevision()
+	if err != nil {
+		return err
+	}
 
 addProfileAfterDBSync:
 	if !o.Opts.CreateRules {
 		goto endOfAddProfile
 	}
 
-	// Check if nat chains exist. Create if it does not
-	err = o.Target("nat", o.GetChainName("nat")).
-		CreateChain()
+	err = o.applyRules()
 	if err != nil {
 		return err
 	}
 
-	err = o.GetState()
+endOfAddProfile:
+	log.Info(ipte.InfoProfileCFG)
+
+	return nil
+}
+
+// applyRules creates the chains and rules of the current operator.Opts.Profile
+// from its state. Disabled profiles are skipped
+func (o *Operator) applyRules() error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":   "applyRules",
+		"Profile": o.Opts.Profile,
+	})
+
+	err := o.GetState()
 	if err != nil {
 		return err
 	}
 
-	err = o.NATLBRules(true)
+	if !o.Opts.Enabled {
+		log.Info(ipte.InfoProfileSkipDisabled)
+		return nil
+	}
+
+	err = o.SetNetns()
+	if err != nil {
+		return err
+	}
+
+	// Check if nat chains exist. Create if it does not. NATLBRules fills it
+	err = o.Target("nat", o.GetChainName("nat")).
+		ensureChain()
+	if err != nil {
+		return err
+	}
+
+	// Only the highest healthy tier is balanced. See Failover for switching tiers later
+	o.Opts.ActiveTier = o.selectTier()
+	err = o.addActiveTier(o.Opts.ActiveTier)
 	if err != nil {
 		return err
 	}
+	o.Target("nat", o.GetChainName("nat"))
 
-	// Check if rule in nat exists for jumping to custom chain. Create if it does not
-	o.Opts.RuleArgs = o.GetCustomNatJumpRule(o.GetChainName(o.Opts.Table))
+	// Limits and the fallback reject are enforced in filter, which runs after the nat decision
+	if o.hasFilterRules() {
+		err = o.LimitRules(true)
+		if err != nil {
+			return err
+		}
+		o.Target("nat", o.GetChainName("nat"))
+	}
+
+	// In hash mode, mark the packets before any of them can reach the chain
+	if o.Opts.LBMode == "hash" {
+		err = o.HashMarkRules(true)
+		if err != nil {
+			return err
+		}
+		o.Target("nat", o.GetChainName("nat"))
+	}
 
-	err = o.InsertRule(1, o.Opts.RuleArgs)
+	err = o.NATLBRules(true)
 	if err != nil {
 		return err
 	}
 
+	// Check if rules in nat exist for jumping to custom chain. Create if they do not
+	natChain := o.GetChainName(o.Opts.Table)
+	for _, o.Opts.RuleArgs = range o.GetCustomNatJumpRules(natChain) {
+		err = o.InsertRule(1, o.Opts.RuleArgs)
+		if err != nil {
+			return err
+		}
+	}
+	for _, o.Opts.RuleArgs = range o.GetCustomNatLocalJumpRules(natChain) {
+		err = o.InsertRule(1, o.Opts.RuleArgs)
+		if err != nil {
+			return err
+		}
+	}
+
 	if o.Opts.ChainLogging {
 		err = o.LogJumpRules(true)
 		if err != nil {
@@ -299,12 +825,6 @@ addProfileAfterDBSync:
 		}
 	}
 
-endOfAddProfile:
-	log.Infof(
-		ipte.InfoProfileCFG,
-		o.Opts.Profile,
-	)
-
 	return nil
 }
 
@@ -312,7 +832,8 @@ endOfAddProfile:
 // and last the profile entries from the local state
 func (o *Operator) DeleteProfile() error {
 	log := o.Logger.WithFields(logrus.Fields{
-		"Stage": "DeleteProfile",
+		"Stage":   "DeleteProfile",
+		"Profile": o.Opts.Profile,
 	})
 
 	// Check if nat chains exist. Delete if it does
@@ -323,83 +844,88 @@ func (o *Operator) DeleteProfile() error {
 		return err
 	}
 
-	var rules []string
-	var exists bool
-
 	if !o.Opts.CreateRules {
 		goto endOfDeleteProfile
 	}
 
-	err = o.NATLBRules(false)
+	err = o.removeRules()
 	if err != nil {
 		return err
 	}
 
-	// Check if rule in nat exists for jumping to custom chain. Delete if it does
-	exists, err = o.IPT.ChainExists(o.Opts.Table, o.Opts.Chain)
+endOfDeleteProfile:
+	err = o.Storage.DeleteProfile(o.Opts.Profile)
 	if err != nil {
+		if err.Error() == fmt.Sprintf(ipte.ErrProfileNotExist, o.Opts.Profile) {
+			log.Warn(err)
+			return nil
+		}
 		return err
 	}
-	if !exists {
-		goto endOfDeleteProfile
-	}
 
-	o.Opts.RuleArgs = o.GetCustomNatJumpRule(o.GetChainName(o.Opts.Table))
-	err = o.RemoveRule(o.Opts.RuleArgs)
+	log.Info(ipte.InfoProfileDelete)
+
+	return nil
+}
+
+// removeRules removes the chains and rules of the current operator.Opts.Profile.
+// The profile state is kept
+func (o *Operator) removeRules() error {
+	err := o.SetNetns()
 	if err != nil {
 		return err
 	}
 
-	err = o.LogJumpRules(false)
+	// Every rule outside the iptlb chains is tagged with its profile
+	err = o.removeTaggedRules()
 	if err != nil {
 		return err
 	}
 
-	// Check if there are other rules that may exist and delete them
-	// Here we will delete any rule that matches the following condition
-	// rule -> HasSuffix(fmt.Sprintf("-J %s", o.GetChainName(o.Table)))
-	rules, err = o.IPT.List(o.Opts.Table, o.Opts.Chain)
-	if err != nil {
-		return err
+	// Rules of older versions have no tag. Their jump rules are matched by the
+	// -j IPTLB_NAT_* suffix, the LOG & HMARK rules are regenerated without the tag
+	for _, j := range o.jumpChains() {
+		err = o.Target("nat", j).removeJumpRules(o.GetChainName("nat"))
+		if err != nil {
+			return err
+		}
 	}
-	for _, j := range rules {
-		if strings.HasSuffix(j, fmt.Sprintf("-j %s", o.GetChainName(o.Opts.Table))) {
-			o.Opts.RuleArgs = strings.Split(j, " ")[1:]
-			err = o.RemoveRule(o.Opts.RuleArgs)
-			if err != nil {
-				return err
-			}
+
+	if o.Opts.ChainLogging {
+		err = o.Target("nat", o.natJumpChain()).RemoveRule(o.untag(o.GetLogJumpRule(o.natJumpChain())))
+		if err != nil {
+			return err
 		}
 	}
 
-	err = o.Target("nat", o.GetChainName("nat")).FlushChain()
-	if err != nil {
-		return err
+	if o.Opts.LBMode == "hash" {
+		err = o.Target("mangle", o.hashMangleChain()).RemoveRule(o.getHMARKRule())
+		if err != nil {
+			return err
+		}
 	}
 
-	err = o.Target("nat", o.GetChainName("nat")).DeleteChain()
+	// Remove the limits even if the profile has none, the chain could be a leftover
+	err = o.LimitRules(false)
 	if err != nil {
 		return err
 	}
 
-endOfDeleteProfile:
-	err = o.Storage.DeleteProfile(o.Opts.Profile)
+	o.Target("nat", o.GetChainName("nat"))
+	exists, err := o.iptChainExists(o.Opts.Table, o.Opts.Chain)
 	if err != nil {
-		if err.Error() == fmt.Sprintf(ipte.ErrProfileNotExist, o.Opts.Profile) {
-			log.Warn(err)
-			return nil
-		}
 		return err
 	}
+	if !exists {
+		return nil
+	}
 
-	log.Infof(ipte.InfoProfileDelete, o.Opts.Profile)
-
-	return nil
+	return o.DeleteChain()
 }
 
 // GetStateSrc for reading the local source state for a given profile
 func (o *Operator) GetStateSrc() error {
-	src, err := o.Storage.GetPath(fmt.Sprintf("%s.source", o.Opts.Profile))
+	src, err := o.Storage.GetPath(o.statePath("source"))
 	if err != nil {
 		return err
 	}
@@ -412,7 +938,7 @@ func (o *Operator) GetStateSrc() error {
 // GetStateDest for reading the local destination state for a given profile
 func (o *Operator) GetStateDest() error {
 	destObj, err := o.Storage.GetPath(
-		fmt.Sprintf("%s.destination", o.Opts.Profile),
+		o.statePath("destination"),
 	)
 	if err != nil {
 		return err
@@ -434,7 +960,7 @@ func (o *Operator) GetStateDest() error {
 
 // GetStateProtocol for reading the local protocol state for a given profile
 func (o *Operator) GetStateProtocol() error {
-	protocol, err := o.Storage.GetPath(fmt.Sprintf("%s.protocol", o.Opts.Profile))
+	protocol, err := o.Storage.GetPath(o.statePath("protocol"))
 	if err != nil {
 		return err
 	}
@@ -446,7 +972,7 @@ func (o *Operator) GetStateProtocol() error {
 
 // GetStateLogLevel for reading the local logLevel state for a given profile
 func (o *Operator) GetStateLogLevel() error {
-	logLevel, err := o.Storage.GetPath(fmt.Sprintf("%s.logLevel", o.Opts.Profile))
+	logLevel, err := o.Storage.GetPath(o.statePath("logLevel"))
 	if err != nil {
 		return err
 	}
@@ -458,7 +984,7 @@ func (o *Operator) GetStateLogLevel() error {
 
 // GetStateProtocol for reading the local logEnabled state for a given profile
 func (o *Operator) GetStateLogEnabled() error {
-	logEnabled, err := o.Storage.GetPath(fmt.Sprintf("%s.logEnabled", o.Opts.Profile))
+	logEnabled, err := o.Storage.GetPath(o.statePath("logEnabled"))
 	if err != nil {
 		return err
 	}
@@ -470,7 +996,7 @@ func (o *Operator) GetStateLogEnabled() error {
 
 // GetStateRulesBackend for reading the local rulesBackend state for a given profile
 func (o *Operator) GetStateRulesBackend() error {
-	rulesBackend, err := o.Storage.GetPath(fmt.Sprintf("%s.rulesBackend", o.Opts.Profile))
+	rulesBackend, err := o.Storage.GetPath(o.statePath("rulesBackend"))
 	if err != nil {
 		return err
 	}
@@ -480,6 +1006,215 @@ func (o *Operator) GetStateRulesBackend() error {
 	return nil
 }
 
+// GetStateClientCIDR for reading the local clientCIDR state for a given profile.
+// Profiles written before client cidrs were supported have no such entry
+func (o *Operator) GetStateClientCIDR() error {
+	o.Opts.ClientCIDR = nil
+
+	clientCIDRObj, err := o.Storage.GetPath(o.statePath("clientCIDR"))
+	if err != nil {
+		return nil
+	}
+
+	o.Storage.AssertFactory.Input(clientCIDRObj)
+	if o.Storage.AssertFactory.GetError() != nil {
+		return o.Storage.AssertFactory.GetError()
+	}
+	clientCIDR, err := o.Storage.AssertFactory.GetArray()
+	if err != nil {
+		return err
+	}
+
+	o.Opts.ClientCIDR = clientCIDR
+
+	return nil
+}
+
+// GetStateInterfaces for reading the local inInterface & outInterface state for a
+// given profile. Profiles written before interfaces were supported have no such entries
+func (o *Operator) GetStateInterfaces() error {
+	o.Opts.InInterface = ""
+	o.Opts.OutInterface = ""
+
+	inInterface, err := o.Storage.GetPath(o.statePath("inInterface"))
+	if err == nil {
+		o.Opts.InInterface, _ = inInterface.(string)
+	}
+
+	outInterface, err := o.Storage.GetPath(o.statePath("outInterface"))
+	if err == nil {
+		o.Opts.OutInterface, _ = outInterface.(string)
+	}
+
+	return nil
+}
+
+// GetStateNetns for reading the local netns state for a given profile.
+// Profiles written before network namespaces were supported have no such entry
+func (o *Operator) GetStateNetns() error {
+	o.Opts.Netns = ""
+
+	netns, err := o.Storage.GetPath(o.statePath("netns"))
+	if err == nil {
+		o.Opts.Netns, _ = netns.(string)
+	}
+
+	return nil
+}
+
+// GetStateLBMode for reading the local lbMode & hashPort state for a given profile.
+// Profiles written before hash mode was supported use random balancing
+func (o *Operator) GetStateLBMode() error {
+	o.Opts.LBMode = "random"
+	o.Opts.HashPort = false
+
+	lbMode, err := o.Storage.GetPath(o.statePath("lbMode"))
+	if err == nil {
+		o.Opts.LBMode, _ = lbMode.(string)
+	}
+
+	hashPort, err := o.Storage.GetPath(o.statePath("hashPort"))
+	if err == nil {
+		o.Opts.HashPort, _ = hashPort.(bool)
+	}
+
+	return nil
+}
+
+// GetStateLimits for reading the local rate & connection limits state for a given profile.
+// Profiles written before limits were supported have no limits
+func (o *Operator) GetStateLimits() error {
+	o.Opts.RateLimit = o.getStateString("rateLimit")
+	o.Opts.RateLimitKey = o.getStateString("rateLimitKey")
+	o.Opts.LimitAction = o.getStateString("limitAction")
+	o.Opts.RateLimitBurst = o.getStateInt("rateLimitBurst")
+	o.Opts.MaxConnsPerDest = o.getStateInt("maxConnsPerDest")
+
+	return nil
+}
+
+// GetStateExpiresAt for reading the local expiration time state for a given profile.
+// Profiles written before expiration was supported never expire
+func (o *Operator) GetStateExpiresAt() error {
+	o.Opts.ExpiresAt = o.getStateString("expiresAt")
+
+	return nil
+}
+
+// GetStateChainName for reading the local chain name state for a given profile.
+// Profiles written before the chain name was stored use the upper-cased profile name
+func (o *Operator) GetStateChainName() error {
+	o.Opts.ChainName = o.getStateString("chainName")
+
+	return nil
+}
+
+// GetStateLabels for reading the local labels state for a given profile
+func (o *Operator) GetStateLabels() error {
+	o.Opts.Labels = o.Storage.GetLabels(o.stateRoot())
+
+	return nil
+}
+
+// SelectProfiles returns the profiles in the state whose labels match
+// operator.Opts.Selector, sorted by name. An empty selector selects every profile
+func (o *Operator) SelectProfiles() ([]string, error) {
+	sel, err := utils.ParseSelector(o.Opts.Selector)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, p := range profiles {
+		if sel.Matches(o.Storage.GetLabels(p)) {
+			selected = append(selected, p)
+		}
+	}
+
+	return selected, nil
+}
+
+// GetStateEnabled for reading the local enabled state for a given profile.
+// Profiles written before profiles could be disabled are enabled
+func (o *Operator) GetStateEnabled() error {
+	o.Opts.Enabled = true
+
+	enabled, err := o.Storage.GetPath(o.statePath("enabled"))
+	if err != nil {
+		return nil
+	}
+
+	v, ok := enabled.(bool)
+	if ok {
+		o.Opts.Enabled = v
+	}
+
+	return nil
+}
+
+// GetStateTiers for reading the local backup destinations and active tier state for a given profile.
+// Profiles written before tiers were supported only have the primary tier
+func (o *Operator) GetStateTiers() error {
+	o.Opts.BackupDest = nil
+	o.Opts.ActiveTier = o.getStateInt("activeTier")
+
+	destObj, err := o.Storage.GetPath(
+		o.statePath("backupDestination"),
+	)
+	if err != nil {
+		return nil
+	}
+
+	o.Storage.AssertFactory.Input(destObj)
+	if o.Storage.AssertFactory.GetError() != nil {
+		return o.Storage.AssertFactory.GetError()
+	}
+	dest, err := o.Storage.AssertFactory.GetArray()
+	if err != nil {
+		return err
+	}
+
+	o.Opts.BackupDest = dest
+
+	return nil
+}
+
+// GetStateFallback for reading the local fallback state for a given profile
+func (o *Operator) GetStateFallback() error {
+	o.Opts.Fallback = o.getStateString("fallback")
+	o.Opts.FallbackDest = o.getStateString("fallbackDest")
+
+	return nil
+}
+
+// getStateString returns the string value of a key of the current profile, or an
+// empty string for keys that profiles written by older versions do not have
+func (o *Operator) getStateString(key string) string {
+	value, err := o.Storage.GetPath(o.statePath(key))
+	if err != nil {
+		return ""
+	}
+
+	v, _ := value.(string)
+	return v
+}
+
+// getStateInt is the same as getStateString for int values
+func (o *Operator) getStateInt(key string) int {
+	value, err := o.Storage.GetPath(o.statePath(key))
+	if err != nil {
+		return 0
+	}
+
+	v, _ := value.(int)
+	return v
+}
+
 // GetState for invoking the GetStateSrc and GetStateDest methods
 func (o *Operator) GetState() error {
 	err := o.GetStateSrc()
@@ -512,5 +1247,60 @@ func (o *Operator) GetState() error {
 		return err
 	}
 
+	err = o.GetStateClientCIDR()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateInterfaces()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateNetns()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateLBMode()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateLimits()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateFallback()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateTiers()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateEnabled()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateLabels()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateExpiresAt()
+	if err != nil {
+		return err
+	}
+
+	err = o.GetStateChainName()
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
@@ -0,0 +1,302 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// Tables are the tables where iptlb creates chains and rules
+var Tables = []string{"nat", "filter", "mangle"}
+
+// Orphan is an iptlb chain, or an iptlb rule of a chain, that no profile owns
+type Orphan struct {
+	Netns, Table, Chain, Rule string
+}
+
+// owners holds what the profiles of a network namespace own
+type owners struct {
+	profiles map[string]bool
+	chains   map[string]bool
+	logIPs   map[string]bool
+	hashSrcs map[string]bool
+}
+
+// key returns the key of chain c of table t in owners.chains
+func chainKey(t, c string) string {
+	return fmt.Sprintf("%s/%s", t, c)
+}
+
+// profileOwners returns what the profiles of the state that live in network namespace
+// netns own: their tagged rules, their custom chains and, for the untagged rules of
+// older versions, the source addresses of their LOG rules and the source socket
+// addresses of their HMARK rules.
+// Method reads each profile into operator.Opts
+func (o *Operator) profileOwners(netns string) (*owners, error) {
+	own := &owners{
+		profiles: make(map[string]bool),
+		chains:   make(map[string]bool),
+		logIPs:   make(map[string]bool),
+		hashSrcs: make(map[string]bool),
+	}
+
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range profiles {
+		o.Opts.Profile = p
+		err = o.GetState()
+		if err != nil {
+			return nil, err
+		}
+		if o.Opts.Netns != netns || !o.Opts.Enabled {
+			continue
+		}
+
+		own.profiles[p] = true
+		own.chains[chainKey("nat", o.GetChainName("nat"))] = true
+		if o.hasFilterRules() {
+			own.chains[chainKey("filter", o.GetChainName("filter"))] = true
+		}
+
+		if o.Opts.ChainLogging {
+			own.logIPs[strings.Split(o.Opts.Src, ":")[0]] = true
+		}
+		if o.Opts.LBMode == "hash" {
+			own.hashSrcs[o.Opts.Src] = true
+		}
+	}
+
+	return own, nil
+}
+
+// ruleArg returns the value of option opt of a rule listed by iptables -S
+func ruleArg(rule []string, opt string) string {
+	for i, j := range rule {
+		if j == opt && i+1 < len(rule) {
+			return rule[i+1]
+		}
+	}
+	return ""
+}
+
+// iptlbRule returns the chain a rule listed by iptables -S jumps to if it is an untagged
+// rule of older versions in a chain that is not an iptlb chain: a jump to an iptlb chain,
+// an iptlb LOG rule or an iptlb HMARK rule. The second value is false for any other rule,
+// including the tagged rules of other iptlb instances
+func (o *Operator) iptlbRule(rule []string) (string, bool) {
+	if ruleArg(rule, "--comment") != "" {
+		return "", false
+	}
+
+	target := ruleArg(rule, "-j")
+	switch {
+	case strings.HasPrefix(target, o.chainPrefix()):
+		return target, true
+	case target == "LOG" && strings.HasPrefix(ruleArg(rule, "--log-prefix"), o.logPrefix()):
+		return target, true
+	case target == "HMARK" && ruleArg(rule, "--hmark-rnd") == hashSeed:
+		return target, true
+	}
+
+	return "", false
+}
+
+// FindOrphans method lists the iptlb chains and rules of every table in the network
+// namespace of operator.Opts.Netns that no enabled profile of the state owns.
+// With all set, every iptlb chain and rule is returned.
+// Method reads each profile into operator.Opts and restores operator.Opts.Netns
+func (o *Operator) FindOrphans(all bool) ([]Orphan, error) {
+	netns := o.Opts.Netns
+	own, err := o.profileOwners(netns)
+	o.Opts.Netns = netns
+	if err != nil {
+		return nil, err
+	}
+	if all {
+		own = &owners{}
+	}
+
+	err = o.SetNetns()
+	if err != nil {
+		return nil, err
+	}
+
+	var orphans []Orphan
+	for _, t := range Tables {
+		chains, err := o.IPT.ListChains(t)
+		if err != nil {
+			return nil, err
+		}
+
+		var orphanChains []Orphan
+		for _, c := range chains {
+			if strings.HasPrefix(c, o.chainPrefix()) {
+				if !own.chains[chainKey(t, c)] {
+					orphanChains = append(orphanChains, Orphan{Netns: netns, Table: t, Chain: c})
+				}
+				continue
+			}
+
+			rules, err := o.iptList(t, c)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range rules {
+				rule := SplitRule(r)
+				if _, p, ok := o.ruleTag(rule); ok {
+					if !own.profiles[p] {
+						orphans = append(orphans, Orphan{Netns: netns, Table: t, Chain: c, Rule: r})
+					}
+					continue
+				}
+
+				target, ok := o.iptlbRule(rule)
+				if !ok {
+					continue
+				}
+
+				ip := strings.TrimSuffix(ruleArg(rule, "-d"), "/32")
+				switch target {
+				case "LOG":
+					if own.logIPs[ip] {
+						continue
+					}
+				case "HMARK":
+					if own.hashSrcs[fmt.Sprintf("%s:%s", ip, ruleArg(rule, "--dport"))] {
+						continue
+					}
+				default:
+					if own.chains[chainKey(t, target)] {
+						continue
+					}
+				}
+				orphans = append(orphans, Orphan{Netns: netns, Table: t, Chain: c, Rule: r})
+			}
+		}
+
+		// Chains are removed after the rules that jump to them
+		orphans = append(orphans, orphanChains...)
+	}
+
+	return orphans, nil
+}
+
+// RemoveOrphans method removes the chains and rules that FindOrphans returns and
+// returns them. The state is not changed
+func (o *Operator) RemoveOrphans(all bool) ([]Orphan, error) {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage": "RemoveOrphans",
+	})
+
+	orphans, err := o.FindOrphans(all)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, j := range orphans {
+		log.WithFields(logrus.Fields{
+			"Netns": j.Netns,
+			"Table": j.Table,
+			"Chain": j.Chain,
+			"Rule":  j.Rule,
+		}).Info(ipte.InfoRemoveOrphan)
+
+		if j.Rule != "" {
+			err = o.Target(j.Table, j.Chain).RemoveRule(SplitRule(j.Rule)[2:])
+		} else {
+			err = o.Target(j.Table, j.Chain).DeleteChain()
+		}
+		if err != nil {
+			return orphans[:i], err
+		}
+	}
+
+	return orphans, nil
+}
+
+// stateNamespaces returns the network namespace of operator.Opts.Netns followed by
+// the other namespaces that the profiles of the state live in. Namespaces that do
+// not exist anymore are skipped, since they have no rules left.
+// Method reads each profile into operator.Opts and restores operator.Opts.Netns
+func (o *Operator) stateNamespaces() ([]string, error) {
+	netns := o.Opts.Netns
+	defer func() {
+		o.Opts.Netns = netns
+	}()
+
+	profiles, err := o.Storage.ListProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{netns}
+	seen := map[string]bool{netns: true}
+	for _, p := range profiles {
+		o.Opts.Profile = p
+		err = o.GetState()
+		if err != nil {
+			return nil, err
+		}
+		if seen[o.Opts.Netns] {
+			continue
+		}
+		seen[o.Opts.Netns] = true
+
+		err = utils.CheckNetns(o.Opts.Netns)
+		if err != nil {
+			o.Logger.WithFields(logrus.Fields{
+				"Stage":   "stateNamespaces",
+				"Profile": p,
+				"Netns":   o.Opts.Netns,
+			}).WithError(err).Warn(ipte.WarnNetnsSkipped)
+			continue
+		}
+		namespaces = append(namespaces, o.Opts.Netns)
+	}
+
+	return namespaces, nil
+}
+
+// CollectOrphans method removes the orphan chains and rules (see RemoveOrphans) of
+// operator.Opts.Netns and of every namespace of the state, and records them in the
+// audit log under action, once per namespace. With all set, everything of iptlb is
+// removed. The state is read again first, since gc -interval keeps running while
+// other iptlb runs change it. Method restores operator.Opts.Netns
+func (o *Operator) CollectOrphans(action string, all bool) ([]Orphan, error) {
+	err := o.Storage.Read()
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces, err := o.stateNamespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	netns := o.Opts.Netns
+	defer func() {
+		o.Opts.Netns = netns
+	}()
+
+	var orphans []Orphan
+	for _, ns := range namespaces {
+		o.Opts.Profile = ""
+		o.Opts.Netns = ns
+		err = o.audit(action, func() error {
+			removed, err := o.RemoveOrphans(all)
+			orphans = append(orphans, removed...)
+			return err
+		})
+		if err != nil {
+			return orphans, err
+		}
+	}
+
+	return orphans, nil
+}
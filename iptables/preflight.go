@@ -0,0 +1,94 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ulfox/iptlb/preflight"
+)
+
+// Requirements method returns what the current operator.Opts profile needs
+// from the host, based on its rules backend and features
+func (o *Operator) Requirements() preflight.Requirements {
+	req := preflight.Requirements{
+		Modules: []string{"iptable_nat"},
+	}
+
+	if o.Opts.LBMode == "hash" {
+		req.Modules = append(req.Modules, "xt_HMARK", "xt_connmark", "xt_mark", "xt_conntrack")
+	} else if len(o.Opts.Dest) > 0 || len(o.Opts.BackupDest) > 0 {
+		req.Modules = append(req.Modules, "xt_statistic")
+	}
+
+	if o.Opts.RulesType == "server" {
+		req.Modules = append(req.Modules, "xt_addrtype")
+	}
+
+	if o.Opts.ChainLogging {
+		req.Modules = append(req.Modules, "xt_LOG")
+	}
+
+	if o.Opts.RateLimit != "" {
+		req.Modules = append(req.Modules, "xt_hashlimit")
+	}
+	if o.Opts.MaxConnsPerDest > 0 {
+		req.Modules = append(req.Modules, "xt_connlimit")
+	}
+	if o.hasFilterRules() {
+		req.Modules = append(req.Modules, "xt_conntrack", "iptable_filter")
+		if o.Opts.LimitAction == "reject" || o.Opts.Fallback == "reject" {
+			req.Modules = append(req.Modules, "xt_REJECT")
+		}
+	}
+
+	var redirect bool
+	for _, j := range o.targets() {
+		if o.isRedirect(j) {
+			redirect = true
+			continue
+		}
+
+		// Every other destination is DNATed. In PREROUTING the packets are then
+		// forwarded, while DNAT to a loopback address needs route_localnet
+		if o.Opts.RulesType != "client" {
+			req.Forwarding = true
+		}
+		ip := net.ParseIP(strings.Split(j, ":")[0])
+		if ip != nil && ip.IsLoopback() {
+			req.RouteLocalnet = true
+		}
+	}
+	if redirect {
+		req.Modules = append(req.Modules, "xt_REDIRECT")
+	}
+
+	if o.Opts.RulesType == "proxy" {
+		req.Forwarding = true
+	}
+
+	return req
+}
+
+// Preflight method runs the preflight checks of the current operator.Opts profile
+// and returns an error that lists the failed checks
+func (o *Operator) Preflight() error {
+	results := preflight.Run(o.Requirements())
+	results = append(results, preflight.CheckIPTablesBackend(o.chainPrefix()))
+
+	failed := preflight.Failed(results)
+	if len(failed) == 0 {
+		return nil
+	}
+
+	var msg []string
+	for _, j := range failed {
+		msg = append(msg, fmt.Sprintf("%s: %s (fix: %s)", j.Check, j.Message, j.Hint))
+	}
+
+	return fmt.Errorf(
+		"profile [%s] failed preflight checks:\n%s",
+		o.Opts.Profile,
+		strings.Join(msg, "\n"),
+	)
+}
@@ -0,0 +1,218 @@
+package iptables
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/state"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// ReplayResult is the outcome of the replay of a profile
+type ReplayResult struct {
+	Profile string
+	Skipped bool
+	Err     error
+}
+
+// Replay method applies every profile of the state that matches operator.Opts.Selector.
+// A profile that fails does not stop the replay, its error is kept in its result.
+// Method returns one result per profile, in the order of the state
+func (o *Operator) Replay() ([]ReplayResult, error) {
+	profiles, err := o.SelectProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ReplayResult, len(profiles))
+	for i, j := range profiles {
+		results[i].Profile = j
+	}
+
+	if o.batchable() {
+		err = o.replayBatched(results)
+	} else {
+		o.replaySequential(results)
+	}
+
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage": "Replay",
+	})
+	for _, j := range results {
+		if j.Err != nil {
+			log.WithField("Profile", j.Profile).WithError(j.Err).Warn(ipte.WarnReplayProfile)
+		}
+	}
+	log.WithField("Profiles", len(results)).Info(ipte.InfoReplayDone)
+
+	return results, err
+}
+
+// batchable reports if the changes of a replay can be applied in one iptables-restore
+// transaction. That is the case when -use-state applies the profiles with -run and
+// nothing is deleted, reset or drained
+func (o *Operator) batchable() bool {
+	return o.Opts.UseState && o.Opts.CreateRules && !o.Opts.Delete && !o.Opts.Reset && !o.Opts.Drain
+}
+
+// replayProfile reads the state of profile p and configures it. A disabled profile
+// is skipped unless it is deleted
+func (o *Operator) replayProfile(r *ReplayResult) {
+	o.Opts.Profile = r.Profile
+
+	// We now get the src & dest addresses from each profile
+	r.Err = o.GetState()
+	if r.Err != nil {
+		return
+	}
+
+	if !o.Opts.Enabled && !o.Opts.Delete {
+		o.Logger.WithField("Profile", r.Profile).Info(ipte.InfoProfileSkipDisabled)
+		r.Skipped = true
+		return
+	}
+
+	r.Err = o.Configure()
+}
+
+// replaySequential configures the profiles of results one after the other
+func (o *Operator) replaySequential(results []ReplayResult) {
+	for i := range results {
+		o.replayProfile(&results[i])
+	}
+}
+
+// replayBatched configures the profiles of results with their iptables changes
+// collected in a restoreBatch, one per network namespace, and commits each batch.
+// The changes of a profile that fails are dropped from the batch
+func (o *Operator) replayBatched(results []ReplayResult) error {
+	var namespaces []string
+	groups := make(map[string][]int)
+	for i, j := range results {
+		o.Opts.Profile = j.Profile
+		err := o.GetState()
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		if _, ok := groups[o.Opts.Netns]; !ok {
+			namespaces = append(namespaces, o.Opts.Netns)
+		}
+		groups[o.Opts.Netns] = append(groups[o.Opts.Netns], i)
+	}
+
+	for _, ns := range namespaces {
+		o.batch = newRestoreBatch()
+		for _, i := range groups[ns] {
+			c := o.batch.checkpoint()
+			o.replayProfile(&results[i])
+			if results[i].Err != nil {
+				o.batch.rollback(c)
+			}
+		}
+
+		batch := o.batch
+		o.batch = nil
+
+		failed, err := o.commitBatch(ns, batch)
+		if err != nil {
+			failed = make(map[string]error)
+			for _, p := range batch.profiles() {
+				failed[p] = err
+			}
+		}
+		for _, i := range groups[ns] {
+			if pErr, ok := failed[results[i].Profile]; ok {
+				results[i].Err = pErr
+			}
+		}
+
+		rErr := o.recordBatch(batch, failed)
+		if err != nil {
+			return err
+		}
+		if rErr != nil {
+			return rErr
+		}
+	}
+
+	return nil
+}
+
+// recordBatch writes the active tiers of batch to the state and records its audit
+// entries, once the batch is committed. The profiles in failed and the profiles whose
+// changes were dropped from the batch are recorded without changes
+func (o *Operator) recordBatch(batch *restoreBatch, failed map[string]error) error {
+	for _, j := range batch.tiers {
+		if _, ok := failed[j.profile]; ok {
+			continue
+		}
+		err := o.Storage.AddActiveTier(j.profile, j.tier)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, j := range batch.audits {
+		if err, ok := failed[j.entry.Profile]; ok && j.err == nil {
+			j.err = err
+		}
+		if j.err != nil {
+			j.changes = state.RuleChanges{}
+		}
+		err := o.recordAudit(j.action, j.entry, j.changes, j.err)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// commitBatch applies batch in network namespace ns in a single iptables-restore
+// transaction, after a backup of the tables. If the transaction fails, the changes
+// of each profile are applied alone and the profiles that fail are returned
+func (o *Operator) commitBatch(ns string, batch *restoreBatch) (map[string]error, error) {
+	if len(batch.lines) == 0 {
+		return nil, nil
+	}
+
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":    "Replay",
+		"Netns":    ns,
+		"Profiles": len(batch.profiles()),
+		"Rules":    len(batch.lines),
+	})
+
+	o.Opts.Profile = ""
+	o.Opts.Netns = ns
+	err := o.SetNetns()
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.prepareBackup("replay", "")
+	if err != nil {
+		return nil, err
+	}
+	err = o.backup()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info(ipte.InfoReplayCommit)
+	err = restore(batch.payload(func(batchLine) bool { return true }))
+	if err == nil {
+		return nil, nil
+	}
+	log.WithError(err).Warn(ipte.WarnReplayCommit)
+
+	failed := make(map[string]error)
+	for _, p := range batch.profiles() {
+		err = restore(batch.payload(func(l batchLine) bool { return l.profile == p }))
+		if err == nil {
+			continue
+		}
+		failed[p] = err
+	}
+
+	return failed, nil
+}
@@ -0,0 +1,184 @@
+package iptables
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// RestoreCmd is the binary used for applying atomic changes to a table
+var RestoreCmd = "iptables-restore"
+
+// ruleArgEscaper escapes the only characters that are escaped within the double
+// quotes of iptables-save, which are the escapes SplitRule reads back
+var ruleArgEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteRuleArg quotes a rule argument the way iptables-save does, so that
+// iptables-restore reads it back as a single argument
+func quoteRuleArg(a string) string {
+	if a != "" && !strings.ContainsAny(a, " \t\"'") {
+		return a
+	}
+	return `"` + ruleArgEscaper.Replace(a) + `"`
+}
+
+// RestoreRule formats rule r of chain c as an iptables-restore line
+func RestoreRule(c string, r []string) string {
+	args := make([]string, 0, len(r)+2)
+	args = append(args, "-A", c)
+	for _, j := range r {
+		args = append(args, quoteRuleArg(j))
+	}
+	return strings.Join(args, " ")
+}
+
+// SplitRule splits a rule as listed by iptables -S or iptables-save into
+// its arguments. Double quoted arguments are kept together
+func SplitRule(r string) []string {
+	var args []string
+	var arg strings.Builder
+	var quoted, escaped, inArg bool
+
+	for _, c := range r {
+		switch {
+		case escaped:
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quoted:
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inArg = true
+		case c == ' ' && !quoted:
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+
+	return args
+}
+
+// Restore feeds the given table payload (everything between *table and
+// COMMIT) to iptables-restore --noflush. The whole payload is applied
+// in a single transaction and chains that are not mentioned are left untouched.
+// During a batched replay the payload is added to the batch instead
+func (o *Operator) Restore(table string, lines []string) error {
+	if o.batch != nil {
+		for _, j := range lines {
+			err := o.batch.record(o, table, j)
+			if err != nil {
+				return err
+			}
+			o.batch.add(o.Opts.Profile, table, j)
+		}
+		return nil
+	}
+
+	var payload bytes.Buffer
+	fmt.Fprintf(&payload, "*%s\n", table)
+	for _, j := range lines {
+		fmt.Fprintln(&payload, j)
+	}
+	fmt.Fprintln(&payload, "COMMIT")
+
+	err := o.backup()
+	if err != nil {
+		return err
+	}
+
+	return restore(payload.Bytes())
+}
+
+// ReplaceChain atomically replaces all the rules of a chain with rules.
+// Declaring the chain in the restore payload flushes it in the same transaction,
+// so there is no window where the chain is empty.
+// Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
+func (o *Operator) ReplaceChain(rules [][]string) error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage": "ReplaceChain",
+		"Table": o.Opts.Table,
+		"Chain": o.Opts.Chain,
+		"Rules": len(rules),
+	})
+
+	lines := []string{fmt.Sprintf(":%s - [0:0]", o.Opts.Chain)}
+	for _, r := range rules {
+		lines = append(lines, RestoreRule(o.Opts.Chain, r))
+	}
+
+	err := o.Restore(o.Opts.Table, lines)
+	if err != nil {
+		return err
+	}
+	log.Info(ipte.InfoReplaceChain)
+
+	return nil
+}
+
+// syncChain atomically replaces the rules of operator.Opts.Table/Chain with rules
+// (see ReplaceChain) and records the difference in operator.Changes. Rules that
+// iptables already has are unchanged. The rules that are gone are matched with
+// the listed rules by tag, since iptables normalizes the rules it lists
+func (o *Operator) syncChain(rules [][]string) error {
+	listed, err := o.iptList(o.Opts.Table, o.Opts.Chain)
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]int)
+	var added, unchanged [][]string
+	for _, r := range rules {
+		exists, err := o.iptExists(o.Opts.Table, o.Opts.Chain, r...)
+		if err != nil {
+			return err
+		}
+		if exists {
+			kept[ruleArg(r, "--comment")]++
+			unchanged = append(unchanged, r)
+			continue
+		}
+		added = append(added, r)
+	}
+
+	var removed [][]string
+	for _, j := range listed {
+		r := SplitRule(j)
+		if len(r) < 2 || r[0] != "-A" {
+			continue
+		}
+		if tag := ruleArg(r, "--comment"); kept[tag] > 0 {
+			kept[tag]--
+			continue
+		}
+		removed = append(removed, r[2:])
+	}
+
+	err = o.ReplaceChain(rules)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range removed {
+		o.Changes.Removed = append(o.Changes.Removed, o.ruleRecord(r))
+	}
+	for _, r := range added {
+		o.Changes.Added = append(o.Changes.Added, o.ruleRecord(r))
+	}
+	for _, r := range unchanged {
+		o.Changes.Unchanged = append(o.Changes.Unchanged, o.ruleRecord(r))
+	}
+
+	return nil
+}
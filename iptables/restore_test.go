@@ -0,0 +1,105 @@
+package iptables
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRestoreRuleRoundTrip(t *testing.T) {
+	tests := []struct {
+		name string
+		rule []string
+		want string
+	}{
+		{
+			name: "plain arguments",
+			rule: []string{"-p", "tcp", "--dport", "80", "-j", "ACCEPT"},
+			want: `-A C -p tcp --dport 80 -j ACCEPT`,
+		},
+		{
+			name: "comment with spaces",
+			rule: []string{"-m", "comment", "--comment", "IPTLB web rule 1", "-j", "RETURN"},
+			want: `-A C -m comment --comment "IPTLB web rule 1" -j RETURN`,
+		},
+		{
+			name: "comment with double quotes",
+			rule: []string{"-m", "comment", "--comment", `say "hi"`, "-j", "RETURN"},
+			want: `-A C -m comment --comment "say \"hi\"" -j RETURN`,
+		},
+		{
+			name: "comment with single quotes",
+			rule: []string{"-m", "comment", "--comment", "it's", "-j", "RETURN"},
+			want: `-A C -m comment --comment "it's" -j RETURN`,
+		},
+		{
+			name: "comment with backslashes",
+			rule: []string{"-m", "comment", "--comment", `a\b "c\"`, "-j", "RETURN"},
+			want: `-A C -m comment --comment "a\\b \"c\\\"" -j RETURN`,
+		},
+		{
+			name: "unquoted backslash",
+			rule: []string{"-m", "comment", "--comment", `a\b`, "-j", "RETURN"},
+			want: `-A C -m comment --comment a\b -j RETURN`,
+		},
+		{
+			name: "comment with a tab",
+			rule: []string{"-m", "comment", "--comment", "a\tb", "-j", "RETURN"},
+			want: "-A C -m comment --comment \"a\tb\" -j RETURN",
+		},
+		{
+			name: "empty argument",
+			rule: []string{"-m", "comment", "--comment", "", "-j", "RETURN"},
+			want: `-A C -m comment --comment "" -j RETURN`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := RestoreRule("C", tt.rule)
+			if line != tt.want {
+				t.Errorf("formatted %s, expected %s", line, tt.want)
+			}
+
+			want := append([]string{"-A", "C"}, tt.rule...)
+			if args := SplitRule(line); !reflect.DeepEqual(args, want) {
+				t.Errorf("split %s into %q, expected %q", line, args, want)
+			}
+		})
+	}
+}
+
+func TestSplitRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want []string
+	}{
+		{
+			name: "iptables -S rule",
+			rule: `-A IPTLB-web -m comment --comment "IPTLB web" -j DNAT --to-destination 10.0.1.2:80`,
+			want: []string{"-A", "IPTLB-web", "-m", "comment", "--comment", "IPTLB web", "-j", "DNAT", "--to-destination", "10.0.1.2:80"},
+		},
+		{
+			name: "repeated spaces",
+			rule: `-A  C   -j  RETURN `,
+			want: []string{"-A", "C", "-j", "RETURN"},
+		},
+		{
+			name: "quotes inside an argument",
+			rule: `-A C --comment a"b c"d`,
+			want: []string{"-A", "C", "--comment", "ab cd"},
+		},
+		{
+			name: "empty rule",
+			rule: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if args := SplitRule(tt.rule); !reflect.DeepEqual(args, tt.want) {
+				t.Errorf("split %s into %q, expected %q", tt.rule, args, tt.want)
+			}
+		})
+	}
+}
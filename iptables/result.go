@@ -0,0 +1,180 @@
+package iptables
+
+import (
+	"encoding/json"
+	"io"
+	"reflect"
+
+	"github.com/ulfox/iptlb/state"
+)
+
+// Result is the outcome of an action on a profile, as reported by -output=json
+type Result struct {
+	Profile string       `json:"profile"`
+	Action  string       `json:"action"`
+	Changed bool         `json:"changed"`
+	Error   string       `json:"error,omitempty"`
+	Chains  ChainResults `json:"chains"`
+	Rules   RuleResults  `json:"rules"`
+}
+
+// ChainResults lists the chains that an action created, deleted or left untouched
+type ChainResults struct {
+	Created   []state.ChainRecord `json:"created"`
+	Deleted   []state.ChainRecord `json:"deleted"`
+	Unchanged []state.ChainRecord `json:"unchanged"`
+}
+
+// RuleResults lists the rules that an action created, deleted or left untouched
+type RuleResults struct {
+	Created   []state.RuleRecord `json:"created"`
+	Deleted   []state.RuleRecord `json:"deleted"`
+	Unchanged []state.RuleRecord `json:"unchanged"`
+}
+
+// Report collects the results of the actions of an iptlb run. Operators
+// add a result for every audited action when operator.Opts.Report is set
+type Report struct {
+	Results []Result `json:"results"`
+}
+
+// newResult returns the result of action on profile. The action changed something
+// if it changed iptables or the state of the profile. Rules and chains that were
+// deleted and created again, e.g. by a reset that did not change the profile, are
+// reported as unchanged
+func newResult(profile, action string, c state.RuleChanges, before, after map[string]interface{}, err error) Result {
+	c.Removed, c.Added, c.Unchanged = netRules(c.Removed, c.Added, c.Unchanged)
+	c.ChainsDeleted, c.ChainsCreated, c.ChainsUnchanged = netChains(c.ChainsDeleted, c.ChainsCreated, c.ChainsUnchanged)
+
+	r := Result{
+		Profile: profile,
+		Action:  action,
+		Changed: c.Changed() || !reflect.DeepEqual(before, after),
+		Chains: ChainResults{
+			Created:   chainRecords(c.ChainsCreated),
+			Deleted:   chainRecords(c.ChainsDeleted),
+			Unchanged: chainRecords(c.ChainsUnchanged),
+		},
+		Rules: RuleResults{
+			Created:   ruleRecords(c.Added),
+			Deleted:   ruleRecords(c.Removed),
+			Unchanged: ruleRecords(c.Unchanged),
+		},
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// netRules moves the rules that are both in removed and added to unchanged
+func netRules(removed, added, unchanged []state.RuleRecord) ([]state.RuleRecord, []state.RuleRecord, []state.RuleRecord) {
+	count := make(map[state.RuleRecord]int)
+	for _, j := range removed {
+		count[j]++
+	}
+
+	var netAdded []state.RuleRecord
+	for _, j := range added {
+		if count[j] > 0 {
+			count[j]--
+			unchanged = append(unchanged, j)
+			continue
+		}
+		netAdded = append(netAdded, j)
+	}
+
+	var netRemoved []state.RuleRecord
+	for _, j := range removed {
+		if count[j] > 0 {
+			count[j]--
+			netRemoved = append(netRemoved, j)
+		}
+	}
+
+	return netRemoved, netAdded, unchanged
+}
+
+// netChains moves the chains that are both in deleted and created to unchanged
+func netChains(deleted, created, unchanged []state.ChainRecord) ([]state.ChainRecord, []state.ChainRecord, []state.ChainRecord) {
+	count := make(map[state.ChainRecord]int)
+	for _, j := range deleted {
+		count[j]++
+	}
+
+	var netCreated []state.ChainRecord
+	for _, j := range created {
+		if count[j] > 0 {
+			count[j]--
+			unchanged = append(unchanged, j)
+			continue
+		}
+		netCreated = append(netCreated, j)
+	}
+
+	var netDeleted []state.ChainRecord
+	for _, j := range deleted {
+		if count[j] > 0 {
+			count[j]--
+			netDeleted = append(netDeleted, j)
+		}
+	}
+
+	return netDeleted, netCreated, unchanged
+}
+
+// chainRecords returns c, or an empty list instead of nil so that json has []
+func chainRecords(c []state.ChainRecord) []state.ChainRecord {
+	if c == nil {
+		return []state.ChainRecord{}
+	}
+	return c
+}
+
+// ruleRecords returns r, or an empty list instead of nil so that json has []
+func ruleRecords(r []state.RuleRecord) []state.RuleRecord {
+	if r == nil {
+		return []state.RuleRecord{}
+	}
+	return r
+}
+
+// Add appends a result to the report
+func (r *Report) Add(result Result) {
+	r.Results = append(r.Results, result)
+}
+
+// Changed reports if any action of the report changed something
+func (r *Report) Changed() bool {
+	for _, j := range r.Results {
+		if j.Changed {
+			return true
+		}
+	}
+	return false
+}
+
+// Write writes the report as a single json document to w. A non nil err is the
+// error the run ended with
+func (r *Report) Write(w io.Writer, err error) error {
+	doc := struct {
+		Changed bool     `json:"changed"`
+		Error   string   `json:"error,omitempty"`
+		Results []Result `json:"results"`
+	}{
+		Changed: r.Changed(),
+		Results: r.Results,
+	}
+	if err != nil {
+		doc.Error = err.Error()
+	}
+	if doc.Results == nil {
+		doc.Results = []Result{}
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(doc)
+}
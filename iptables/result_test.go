@@ -0,0 +1,208 @@
+package iptables
+
+import (
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/state"
+)
+
+// testOperator returns an Operator for a client profile that reads and writes
+// iptables through a restoreBatch only, so no iptables binary is needed
+func testOperator() *Operator {
+	l := logrus.New()
+	l.SetOutput(io.Discard)
+
+	return &Operator{
+		Opts: &OperatorOpts{
+			Profile:   "test",
+			Prefix:    "IPTLB",
+			Src:       "10.0.0.1:80",
+			Dest:      []string{"10.0.1.2:80", "10.0.1.3:80"},
+			Protocol:  "tcp",
+			RulesType: "client",
+			LBMode:    "random",
+			LogLevel:  "4",
+			Enabled:   true,
+		},
+		Logger: l,
+		batch:  newRestoreBatch(),
+	}
+}
+
+// normalized returns rule r the way iptables -S lists it
+func normalized(r []string) []string {
+	rule := append([]string{}, r...)
+	for i, j := range rule {
+		if i > 0 && rule[i-1] == "-d" && !strings.Contains(j, "/") {
+			rule[i] = j + "/32"
+		}
+	}
+	return rule
+}
+
+func TestResetResult(t *testing.T) {
+	before := map[string]interface{}{"source": "10.0.0.1:80"}
+
+	tests := []struct {
+		name      string
+		extra     []string
+		unchanged bool
+	}{
+		{
+			name:      "unchanged reset",
+			unchanged: true,
+		},
+		{
+			name:  "removed destination",
+			extra: []string{"-p", "tcp", "-d", "10.0.0.1", "--dport", "80", "-m", "comment", "--comment", "iptlb:test:lb:10.0.1.9:80", "-j", "DNAT", "--to-destination", "10.0.1.9:80"},
+		},
+		{
+			name:  "changed rule with the same tag",
+			extra: []string{"-p", "tcp", "-d", "10.0.0.1", "--dport", "80", "-m", "statistic", "--mode", "random", "--probability", "0.33333", "-m", "comment", "--comment", "iptlb:test:lb:10.0.1.2:80", "-j", "DNAT", "--to-destination", "10.0.1.2:80"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOperator()
+			table, chain := "nat", o.GetChainName("nat")
+			want := o.chainRules()
+
+			// iptables has the rules of the profile and lists them normalized
+			ch := &batchChain{exists: true, flushed: true}
+			var listed [][]string
+			for _, r := range want {
+				ch.added = append(ch.added, strings.Join(r, " "))
+				listed = append(listed, normalized(r))
+			}
+			if tt.extra != nil {
+				listed = append(listed, normalized(tt.extra))
+			}
+			o.batch.chains[batchKey(table, chain)] = ch
+
+			o.Target(table, chain)
+			forms, err := o.createdForms(table, chain, listed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if o.Opts.Table != table || o.Opts.Chain != chain {
+				t.Fatalf("target is %s/%s, expected %s/%s", o.Opts.Table, o.Opts.Chain, table, chain)
+			}
+
+			var changes state.RuleChanges
+			for _, r := range forms {
+				changes.Removed = append(changes.Removed, o.ruleRecord(r))
+			}
+			for _, r := range want {
+				changes.Added = append(changes.Added, o.ruleRecord(r))
+			}
+
+			r := newResult("test", "reset", changes, before, before, nil)
+			if r.Changed == tt.unchanged {
+				t.Errorf("changed is %t, expected %t", r.Changed, !tt.unchanged)
+			}
+			if len(r.Rules.Unchanged) != len(want) {
+				t.Errorf("%d unchanged rules, expected %d", len(r.Rules.Unchanged), len(want))
+			}
+			if len(r.Rules.Created) != 0 {
+				t.Errorf("%d created rules, expected none", len(r.Rules.Created))
+			}
+			if !tt.unchanged && len(r.Rules.Deleted) != 1 {
+				t.Errorf("%d deleted rules, expected 1", len(r.Rules.Deleted))
+			}
+		})
+	}
+}
+
+func TestSameAsStateTTL(t *testing.T) {
+	expires := func(d time.Duration) string {
+		return time.Now().Add(d).UTC().Format(time.RFC3339)
+	}
+
+	tests := []struct {
+		name      string
+		storedTTL time.Duration
+		ttl       time.Duration
+		expiresAt string
+		dest      []string
+		same      bool
+	}{
+		{
+			name:      "re-run with -ttl",
+			storedTTL: time.Hour,
+			ttl:       time.Hour,
+			same:      true,
+		},
+		{
+			name:      "re-run with another -ttl",
+			storedTTL: time.Hour,
+			ttl:       2 * time.Hour,
+			same:      true,
+		},
+		{
+			name: "-ttl added to a profile without expiration",
+			ttl:  time.Hour,
+		},
+		{
+			name:      "-ttl removed",
+			storedTTL: time.Hour,
+		},
+		{
+			name:      "changed -expires-at",
+			storedTTL: time.Hour,
+			expiresAt: expires(3 * time.Hour),
+		},
+		{
+			name:      "changed destinations with -ttl",
+			storedTTL: time.Hour,
+			ttl:       time.Hour,
+			dest:      []string{"10.0.1.2:80"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := state.NewStateFactory(filepath.Join(t.TempDir(), "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			o := testOperator()
+			o.batch = nil
+			o.Storage = db
+			if tt.storedTTL != 0 {
+				o.Opts.ExpiresAt = expires(tt.storedTTL)
+			}
+			err = o.AddProfile()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The same command runs again a minute later
+			o = testOperator()
+			o.batch = nil
+			o.Storage = db
+			o.Opts.TTL = tt.ttl
+			o.Opts.ExpiresAt = tt.expiresAt
+			if tt.ttl != 0 {
+				o.Opts.ExpiresAt = expires(tt.ttl + time.Minute)
+			}
+			if tt.dest != nil {
+				o.Opts.Dest = tt.dest
+			}
+
+			same, err := o.SameAsState()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if same != tt.same {
+				t.Errorf("same is %t, expected %t", same, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package iptables
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// Revision is a prior version of a profile as kept in the state
+type Revision struct {
+	Revision  int
+	Timestamp string
+	Opts      OperatorOpts
+}
+
+// stateRoot returns the state path of the profile that GetState reads:
+// operator.Opts.Profile or one of its revisions
+func (o *Operator) stateRoot() string {
+	if o.root != "" {
+		return o.root
+	}
+	return o.Opts.Profile
+}
+
+// statePath returns the state path of key of the profile that GetState reads
+func (o *Operator) statePath(key string) string {
+	return fmt.Sprintf("%s.%s", o.stateRoot(), key)
+}
+
+// revisionValue returns the value of key in a revision of the state
+func revisionValue(r interface{}, key string) interface{} {
+	switch m := r.(type) {
+	case map[interface{}]interface{}:
+		return m[key]
+	case map[string]interface{}:
+		return m[key]
+	}
+	return nil
+}
+
+// revisionNumber returns the number of a revision in the state
+func revisionNumber(r interface{}) int {
+	v, _ := revisionValue(r, "revision").(int)
+	return v
+}
+
+// addRevision appends the current state of operator.Opts.Profile to its revisions and
+// drops the oldest revisions beyond operator.Opts.Revisions. Revisions kept by a
+// reset (see configure) are used when the profile has none
+func (o *Operator) addRevision() error {
+	revisions := o.Storage.GetRevisions(o.Opts.Profile)
+	if len(revisions) == 0 {
+		revisions = o.kept
+	}
+	o.kept = nil
+
+	if o.Opts.Revisions <= 0 {
+		return nil
+	}
+
+	current, err := o.Storage.GetProfile(o.Opts.Profile)
+	if err != nil {
+		return err
+	}
+	if current == nil {
+		return fmt.Errorf(ipte.ErrProfileNotExist, o.Opts.Profile)
+	}
+
+	// Runtime state, not settings of the profile
+	delete(current, "activeTier")
+	delete(current, "enabled")
+
+	n := 1
+	if len(revisions) > 0 {
+		n = revisionNumber(revisions[len(revisions)-1]) + 1
+	}
+	current["revision"] = n
+	current["timestamp"] = time.Now().UTC().Format(time.RFC3339)
+
+	revisions = append(revisions, current)
+	if len(revisions) > o.Opts.Revisions {
+		revisions = revisions[len(revisions)-o.Opts.Revisions:]
+	}
+
+	return o.Storage.SetRevisions(o.Opts.Profile, revisions)
+}
+
+// revisionIndex returns the index of revision n of operator.Opts.Profile in its
+// revisions. With n 0, the revision before the latest one is used
+func (o *Operator) revisionIndex(n int) (int, error) {
+	revisions := o.Storage.GetRevisions(o.Opts.Profile)
+
+	if n == 0 {
+		if len(revisions) < 2 {
+			return 0, fmt.Errorf(ipte.ErrNoRevision, o.Opts.Profile)
+		}
+		return len(revisions) - 2, nil
+	}
+
+	for i, j := range revisions {
+		if revisionNumber(j) == n {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf(ipte.ErrRevisionNotExist, n, o.Opts.Profile)
+}
+
+// getStateRevision reads revision index i of operator.Opts.Profile into operator.Opts
+func (o *Operator) getStateRevision(i int) error {
+	o.root = fmt.Sprintf("%s.revisions.[%d]", o.Opts.Profile, i)
+	defer func() { o.root = "" }()
+
+	return o.GetState()
+}
+
+// Revisions method returns the revisions of operator.Opts.Profile, oldest first.
+// Method reads each revision into operator.Opts and restores the profile state
+func (o *Operator) Revisions() ([]Revision, error) {
+	err := o.loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []Revision
+	for i, j := range o.Storage.GetRevisions(o.Opts.Profile) {
+		err = o.getStateRevision(i)
+		if err != nil {
+			return nil, err
+		}
+
+		timestamp, _ := revisionValue(j, "timestamp").(string)
+		revisions = append(revisions, Revision{
+			Revision:  revisionNumber(j),
+			Timestamp: timestamp,
+			Opts:      *o.Opts,
+		})
+	}
+
+	return revisions, o.GetState()
+}
+
+// Rollback method re-applies revision n of operator.Opts.Profile (the revision before
+// the latest one when n is 0) with the reset path. The rollback is recorded as a new
+// revision
+func (o *Operator) Rollback(n int) error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":   "Rollback",
+		"Profile": o.Opts.Profile,
+	})
+
+	err := o.loadProfile()
+	if err != nil {
+		return err
+	}
+
+	i, err := o.revisionIndex(n)
+	if err != nil {
+		return err
+	}
+
+	err = o.getStateRevision(i)
+	if err != nil {
+		return err
+	}
+
+	o.Opts.Reset = true
+	o.Opts.Delete = false
+	o.Opts.UseState = false
+
+	log.WithField("Revision", revisionNumber(o.Storage.GetRevisions(o.Opts.Profile)[i])).Info(ipte.InfoRollback)
+
+	return o.audit("rollback", o.configure)
+}
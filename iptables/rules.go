@@ -5,30 +5,69 @@ import (
 	"strings"
 
 	"github.com/sirupsen/logrus"
+	"github.com/ulfox/iptlb/state"
 	ipte "github.com/ulfox/iptlb/utils/logs"
 )
 
-func GetLogRule(s, p, c, lv string) []string {
+// GetLogRule returns the LOG rule for packets sent to source s with protocol p
+// that is placed next to the jump rule on chain c. The log prefix starts with lp.
+// Interfaces i & ot add the -i/-o matches when they are not empty
+func GetLogRule(s, p, i, ot, lp, c, lv string) []string {
 	rule := []string{
 		"-d",
 		strings.Split(s, ":")[0],
 		"-p",
 		p,
+	}
+	if i != "" {
+		rule = append(rule, "-i", i)
+	}
+	if ot != "" {
+		rule = append(rule, "-o", ot)
+	}
+
+	return append(
+		rule,
 		"-j",
 		"LOG",
 		"--log-prefix",
-		fmt.Sprintf("IPTLB:%s:ACCEPT:", c),
+		shortLogPrefix(fmt.Sprintf("%s%s:ACCEPT:", lp, c)),
+		"--log-level",
+		lv,
+	)
+}
+
+// GetChainLogRule returns the LOG rule that is placed on top of custom chain c
+// when chain logging is enabled
+func GetChainLogRule(c, lv string) []string {
+	return []string{
+		"-j",
+		"LOG",
+		"--log-prefix",
+		shortLogPrefix(fmt.Sprintf("%s:ACCEPT:", c)),
 		"--log-level",
 		lv,
 	}
+}
 
-	return rule
+// GetClientDenyRule returns the rule that returns packets from a denied client
+// cidr c before they reach the LB rules of a custom chain
+func GetClientDenyRule(c string) []string {
+	return []string{
+		"-s",
+		c,
+		"-j",
+		"RETURN",
+	}
 }
 
-func GetLBRule(s, p, j string, d, i int) []string {
+// GetLBRule returns the rule that sends the connections of protocol pr to socket
+// s:p to target t, e.g. a DNAT or a REDIRECT (see lbTarget). With d destinations,
+// the rule of destination i matches 1/(d-i) of the connections that reach it
+func GetLBRule(pr, s, p string, d, i int, t []string) []string {
 	rule := []string{
 		"-p",
-		"tcp",
+		pr,
 		"-d",
 		s,
 		"--dport",
@@ -39,18 +78,64 @@ func GetLBRule(s, p, j string, d, i int) []string {
 		"random",
 		"--probability",
 		fmt.Sprintf("%0.5f", 1.0/float64(d-i)),
-		"-j",
-		"DNAT",
-		"--to-destination",
-		j,
 	}
-	return rule
+	return append(rule, t...)
+}
+
+// ruleFields returns the structured log fields that describe rule r on
+// the current operator.Opts.Table & operator.Opts.Chain
+func (o *Operator) ruleFields(r []string) logrus.Fields {
+	return logrus.Fields{
+		"Rule":  strings.Join(r, " "),
+		"Table": o.Opts.Table,
+		"Chain": o.Opts.Chain,
+	}
+}
+
+// ruleRecord returns rule r on the current operator.Opts.Table & operator.Opts.Chain
+// in the form that is kept in the audit log
+func (o *Operator) ruleRecord(r []string) state.RuleRecord {
+	return state.RuleRecord{
+		Table: o.Opts.Table,
+		Chain: o.Opts.Chain,
+		Rule:  strings.Join(r, " "),
+	}
+}
+
+// chainRecord returns the record of operator.Opts.Table/Chain for operator.Changes
+func (o *Operator) chainRecord() state.ChainRecord {
+	return state.ChainRecord{
+		Table: o.Opts.Table,
+		Chain: o.Opts.Chain,
+	}
+}
+
+// removeJumpRules removes every rule of operator.Opts.Chain that jumps to chain t.
+// Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
+func (o *Operator) removeJumpRules(t string) error {
+	rules, err := o.iptList(o.Opts.Table, o.Opts.Chain)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range rules {
+		if strings.HasSuffix(j, fmt.Sprintf("-j %s", t)) {
+			// Drop the -A CHAIN prefix of the listed rule
+			o.Opts.RuleArgs = SplitRule(j)[2:]
+			err = o.RemoveRule(o.Opts.RuleArgs)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
 }
 
 // RuleExists checks if a rule exists under a chain for a given table.
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) RuleExists(r []string) (bool, error) {
-	if isExists, err := o.IPT.Exists(o.Opts.Table, o.Opts.Chain, r...); !isExists {
+	if isExists, err := o.iptExists(o.Opts.Table, o.Opts.Chain, r...); !isExists {
 		if err != nil {
 			return false, err
 		}
@@ -63,8 +148,9 @@ func (o *Operator) RuleExists(r []string) (bool, error) {
 // InsertRule for adding a new rule to a specific index p on a given chain.
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) InsertRule(p int, r []string) error {
-	log := o.Logger.WithFields(logrus.Fields{
-		"Stage": "InsertRule",
+	log := o.Logger.WithFields(o.ruleFields(r)).WithFields(logrus.Fields{
+		"Stage":    "InsertRule",
+		"Position": p,
 	})
 
 	ruleExists, err := o.RuleExists(r)
@@ -73,28 +159,22 @@ func (o *Operator) InsertRule(p int, r []string) error {
 	}
 
 	if ruleExists {
-		log.Infof(
-			ipte.InfoInsertRuleAlreadyExists,
-			strings.Join(r, " "),
-			p,
-			o.Opts.Table,
-			o.Opts.Chain,
-		)
+		log.Info(ipte.InfoInsertRuleAlreadyExists)
+		o.Changes.Unchanged = append(o.Changes.Unchanged, o.ruleRecord(r))
 		return nil
 	}
 
-	log.Infof(
-		ipte.InfoInsertRule,
-		strings.Join(r, " "),
-		p,
-		o.Opts.Table,
-		o.Opts.Chain,
-	)
+	log.Info(ipte.InfoInsertRule)
 
-	err = o.IPT.Insert(o.Opts.Table, o.Opts.Chain, p, r...)
+	err = o.backup()
+	if err != nil {
+		return err
+	}
+	err = o.iptInsert(o.Opts.Table, o.Opts.Chain, p, r...)
 	if err != nil {
 		return err
 	}
+	o.Changes.Added = append(o.Changes.Added, o.ruleRecord(r))
 
 	return nil
 }
@@ -102,7 +182,7 @@ func (o *Operator) InsertRule(p int, r []string) error {
 // AddRule for adding a new rule
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) AddRule(r []string) error {
-	log := o.Logger.WithFields(logrus.Fields{
+	log := o.Logger.WithFields(o.ruleFields(r)).WithFields(logrus.Fields{
 		"Stage": "AddRule",
 	})
 
@@ -112,26 +192,22 @@ func (o *Operator) AddRule(r []string) error {
 	}
 
 	if ruleExists {
-		log.Infof(
-			ipte.InfoAppendRuleAlreadyExists,
-			strings.Join(r, " "),
-			o.Opts.Table,
-			o.Opts.Chain,
-		)
+		log.Info(ipte.InfoAppendRuleAlreadyExists)
+		o.Changes.Unchanged = append(o.Changes.Unchanged, o.ruleRecord(r))
 		return nil
 	}
 
-	log.Infof(
-		ipte.InfoAppendRule,
-		strings.Join(r, " "),
-		o.Opts.Table,
-		o.Opts.Chain,
-	)
+	log.Info(ipte.InfoAppendRule)
 
-	err = o.IPT.Append(o.Opts.Table, o.Opts.Chain, r...)
+	err = o.backup()
+	if err != nil {
+		return err
+	}
+	err = o.iptAppend(o.Opts.Table, o.Opts.Chain, r...)
 	if err != nil {
 		return err
 	}
+	o.Changes.Added = append(o.Changes.Added, o.ruleRecord(r))
 
 	return nil
 }
@@ -139,7 +215,7 @@ func (o *Operator) AddRule(r []string) error {
 // RemoveRule for removing a given rule
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters
 func (o *Operator) RemoveRule(r []string) error {
-	log := o.Logger.WithFields(logrus.Fields{
+	log := o.Logger.WithFields(o.ruleFields(r)).WithFields(logrus.Fields{
 		"Stage": "RemoveRule",
 	})
 
@@ -151,78 +227,77 @@ func (o *Operator) RemoveRule(r []string) error {
 	if !ruleExists {
 		return nil
 	}
-	err = o.IPT.Delete(o.Opts.Table, o.Opts.Chain, r...)
+	err = o.backup()
 	if err != nil {
 		return err
 	}
+	err = o.iptDelete(o.Opts.Table, o.Opts.Chain, r...)
+	if err != nil {
+		return err
+	}
+	o.Changes.Removed = append(o.Changes.Removed, o.ruleRecord(r))
 
-	log.Infof(
-		ipte.InfoDeleteRule,
-		strings.Join(r, " "),
-		o.Opts.Table,
-		o.Opts.Chain,
-	)
+	log.Info(ipte.InfoDeleteRule)
 
 	return nil
 }
 
-// NATLBRules for creating rules that share the same probability for a given chain
+// NATLBRules for creating (t=true) or removing the rules of the custom nat chain.
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters.
 // Method also uses operator.Opts.Profile, operator.Opts.Src, operator.Opts.Dest and o.Opts.Protocol.
-// Src is used to capture the inbound packets and Dest to apply DNAT to a different socket address
+// Src is used to capture the inbound packets and Dest to apply DNAT to a different socket address.
+// On create the chain is replaced as a whole, so a replay that picks another tier
+// does not leave the rules of the old tier behind or add the new ones after RETURN
 func (o *Operator) NATLBRules(t bool) error {
 	log := o.Logger.WithFields(logrus.Fields{
 		"Stage": "NATLBRules",
 	})
 
-	srcAddrSlice := strings.Split(o.Opts.Src, ":")
-
-	for i, j := range o.Opts.Dest {
-		ruleArgs := GetLBRule(srcAddrSlice[0], srcAddrSlice[1], j, len(o.Opts.Dest), i)
-		if t {
-			err := o.AddRule(ruleArgs)
-			if err != nil {
-				return err
-			}
-		} else {
-			err := o.RemoveRule(ruleArgs)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	ruleArgs := []string{
-		"-j",
-		"RETURN",
-	}
 	if t {
-		err := o.AddRule(ruleArgs)
+		err := o.syncChain(o.chainRules())
 		if err != nil {
 			return err
 		}
 	} else {
-		err := o.RemoveRule(ruleArgs)
-		if err != nil {
-			return err
+		for _, ruleArgs := range o.lbRules() {
+			err := o.RemoveRule(ruleArgs)
+			if err != nil {
+				return err
+			}
 		}
 	}
 
-	log.Infof(
-		ipte.InfoDoneChainCFG,
-		o.Opts.Table,
-		o.Opts.Chain,
-	)
+	log.WithFields(logrus.Fields{
+		"Table": o.Opts.Table,
+		"Chain": o.Opts.Chain,
+	}).Info(ipte.InfoDoneChainCFG)
 
 	return nil
 }
 
+// GetLogJumpRule method returns the tagged LOG rule of the profile for jump chain c
+func (o *Operator) GetLogJumpRule(c string) []string {
+	return o.tag(
+		GetLogRule(
+			o.Opts.Src,
+			o.Opts.Protocol,
+			o.Opts.InInterface,
+			o.Opts.OutInterface,
+			o.logPrefix(),
+			c,
+			o.Opts.LogLevel,
+		),
+		RoleLog,
+		"",
+	)
+}
+
 // LogJumpRules for inserting to index 1 in a given chain a loggin rule.
 // The rule is used to log packets on default chains were we apply the jump to custom NAT.
 // Method uses operator.Opts.Table & operator.Opts.Chain to set the table and chain parameters.
 // Method also uses o.Opts.Src, o.Opts.Dest, o.Opts.Protocol
 func (o *Operator) LogJumpRules(t bool) error {
-	ruleArgs := GetLogRule(o.Opts.Src, o.Opts.Protocol, o.Opts.Chain, o.Opts.LogLevel)
+	ruleArgs := o.GetLogJumpRule(o.Opts.Chain)
 	if t {
 		err := o.InsertRule(1, ruleArgs)
 		if err != nil {
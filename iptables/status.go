@@ -0,0 +1,102 @@
+package iptables
+
+import "sort"
+
+// Values of ProfileStatus.Applied
+const (
+	StatusApplied    = "yes"
+	StatusNotApplied = "no"
+	StatusPartial    = "partial"
+)
+
+// ProfileStatus is the live state of a profile's rules. Missing are the rules the
+// profile should have but iptables does not, Unexpected the rules tagged with the
+// profile that it should not have. Both are listed as table/chain/tag, so a rule
+// that was edited by hand is listed in both
+type ProfileStatus struct {
+	Profile, Applied    string
+	Enabled             bool
+	Labels              map[string]string
+	Missing, Unexpected []string
+}
+
+// Drift returns true if the rules of the profile differ from its state
+func (s *ProfileStatus) Drift() bool {
+	return len(s.Unexpected) > 0 || s.Applied == StatusPartial
+}
+
+// Status method reads the state of operator.Opts.Profile and compares the rules it
+// should have with the rules tagged with the profile in its network namespace
+func (o *Operator) Status() (*ProfileStatus, error) {
+	err := o.loadProfile()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ProfileStatus{
+		Profile: o.Opts.Profile,
+		Applied: StatusNotApplied,
+		Enabled: o.Opts.Enabled,
+		Labels:  o.Opts.Labels,
+	}
+
+	err = o.SetNetns()
+	if err != nil {
+		return nil, err
+	}
+
+	found, err := o.taggedRules()
+	if err != nil {
+		return nil, err
+	}
+
+	status.Missing, status.Unexpected, err = o.ruleDrift(found)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(found) == 0 {
+		return status, nil
+	}
+
+	status.Applied = StatusApplied
+	if len(status.Missing) > 0 {
+		status.Applied = StatusPartial
+	}
+
+	return status, nil
+}
+
+// ruleDrift compares the rules found tagged with operator.Opts.Profile with the
+// rules the profile should have and returns the missing and the unexpected ones
+// (see ProfileStatus). A found rule stands for a rule of the profile when it has its
+// tag and iptables has the whole rule, since iptables normalizes the rules it lists
+func (o *Operator) ruleDrift(found []taggedRule) ([]string, []string, error) {
+	count := make(map[string]int)
+	for _, r := range found {
+		count[r.key()]++
+	}
+
+	var missing, unexpected []string
+	for _, r := range o.profileRules() {
+		exists, err := o.iptExists(r.Table, r.Chain, r.Rule...)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !exists || count[r.key()] == 0 {
+			missing = append(missing, r.key())
+			continue
+		}
+		count[r.key()]--
+	}
+
+	for k, v := range count {
+		for ; v > 0; v-- {
+			unexpected = append(unexpected, k)
+		}
+	}
+	sort.Strings(unexpected)
+	sort.Strings(missing)
+
+	return missing, unexpected, nil
+}
@@ -0,0 +1,89 @@
+package iptables
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRuleDrift(t *testing.T) {
+	tests := []struct {
+		name       string
+		edit       func(r taggedRule) []string
+		missing    int
+		unexpected int
+	}{
+		{
+			name: "in sync",
+		},
+		{
+			name: "changed destination",
+			edit: func(r taggedRule) []string {
+				if ruleArg(r.Rule, "--to-destination") != "10.0.1.2:80" {
+					return r.Rule
+				}
+				rule := append([]string{}, r.Rule...)
+				rule[len(rule)-1] = "10.0.9.9:80"
+				return rule
+			},
+			missing:    1,
+			unexpected: 1,
+		},
+		{
+			name: "changed match",
+			edit: func(r taggedRule) []string {
+				if ruleArg(r.Rule, "--to-destination") != "10.0.1.2:80" {
+					return r.Rule
+				}
+				return append([]string{"-s", "10.9.0.0/16"}, r.Rule...)
+			},
+			missing:    1,
+			unexpected: 1,
+		},
+		{
+			name: "removed rule",
+			edit: func(r taggedRule) []string {
+				if ruleArg(r.Rule, "-j") == "RETURN" {
+					return nil
+				}
+				return r.Rule
+			},
+			missing: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := testOperator()
+
+			// iptables has the rules of the profile, the ones that edit returns
+			var found []taggedRule
+			for _, r := range o.profileRules() {
+				rule := r.Rule
+				if tt.edit != nil {
+					rule = tt.edit(r)
+				}
+
+				key := batchKey(r.Table, r.Chain)
+				if o.batch.chains[key] == nil {
+					o.batch.chains[key] = &batchChain{exists: true, flushed: true}
+				}
+				if rule == nil {
+					continue
+				}
+				o.batch.chains[key].added = append(o.batch.chains[key].added, strings.Join(rule, " "))
+				found = append(found, taggedRule{Table: r.Table, Chain: r.Chain, Rule: rule})
+			}
+
+			missing, unexpected, err := o.ruleDrift(found)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(missing) != tt.missing {
+				t.Errorf("missing %v, expected %d rules", missing, tt.missing)
+			}
+			if len(unexpected) != tt.unexpected {
+				t.Errorf("unexpected %v, expected %d rules", unexpected, tt.unexpected)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package iptables
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Roles of the tagged rules
+const (
+	RoleJump      = "jump"
+	RoleLocalJump = "local-jump"
+	RoleLog       = "log"
+	RoleChainLog  = "chain-log"
+	RoleDeny      = "deny"
+	RoleLB        = "lb"
+	RoleFallback  = "fallback"
+	RoleReturn    = "return"
+	RoleHashMark  = "hash-mark"
+	RoleLimitJump = "limit-jump"
+	RoleRateLimit = "rate-limit"
+	RoleOverflow  = "overflow"
+)
+
+// insertMatch inserts match m before the target (-j) of rule r
+func insertMatch(r []string, m ...string) []string {
+	for i, j := range r {
+		if j != "-j" {
+			continue
+		}
+
+		rule := append([]string{}, r[:i]...)
+		rule = append(rule, m...)
+		return append(rule, r[i:]...)
+	}
+
+	return append(append([]string{}, r...), m...)
+}
+
+// GetTag returns the comment that tags the rules of profile p with role
+// and the optional destination d: <prefix>:<profile>:<role>[:<dest>], where
+// prefix is the lower-cased chain prefix, e.g. iptlb:
+func (o *Operator) GetTag(p, role, d string) string {
+	if d == "" {
+		return fmt.Sprintf("%s%s:%s", o.tagPrefix(), p, role)
+	}
+	return fmt.Sprintf("%s%s:%s:%s", o.tagPrefix(), p, role, d)
+}
+
+// tag returns rule r tagged with the comment of operator.Opts.Profile, role
+// and the optional destination d (see GetTag)
+func (o *Operator) tag(r []string, role, d string) []string {
+	return insertMatch(r, "-m", "comment", "--comment", o.GetTag(o.Opts.Profile, role, d))
+}
+
+// untag returns rule r without its iptlb comment match
+func (o *Operator) untag(r []string) []string {
+	for i := 0; i+3 < len(r); i++ {
+		if r[i] == "-m" && r[i+1] == "comment" && r[i+2] == "--comment" && strings.HasPrefix(r[i+3], o.tagPrefix()) {
+			return append(append([]string{}, r[:i]...), r[i+4:]...)
+		}
+	}
+
+	return r
+}
+
+// ruleTag returns the tag of a rule listed by iptables -S and the profile
+// it belongs to. The last value is false for rules without a tag of the
+// iptlb instance
+func (o *Operator) ruleTag(rule []string) (string, string, bool) {
+	tag := ruleArg(rule, "--comment")
+	if !strings.HasPrefix(tag, o.tagPrefix()) {
+		return "", "", false
+	}
+
+	fields := strings.SplitN(strings.TrimPrefix(tag, o.tagPrefix()), ":", 2)
+	if len(fields) != 2 {
+		return "", "", false
+	}
+
+	return tag, fields[0], true
+}
+
+// taggedRule is a rule of a profile in table/chain
+type taggedRule struct {
+	Table, Chain string
+	Rule         []string
+}
+
+// key returns the key that identifies the rule when the rules that a profile
+// should have are compared with the rules iptables has. The tag is used instead
+// of the rule, since iptables normalizes the rules it lists
+func (r taggedRule) key() string {
+	return fmt.Sprintf("%s/%s/%s", r.Table, r.Chain, ruleArg(r.Rule, "--comment"))
+}
+
+// profileRules returns every rule that operator.Opts.Profile should have when
+// it is applied. Disabled profiles have no rules
+func (o *Operator) profileRules() []taggedRule {
+	if !o.Opts.Enabled {
+		return nil
+	}
+
+	var rules []taggedRule
+	add := func(t, c string, r [][]string) {
+		for _, j := range r {
+			rules = append(rules, taggedRule{Table: t, Chain: c, Rule: j})
+		}
+	}
+
+	natChain := o.GetChainName("nat")
+	jumpChain := o.natJumpChain()
+	add("nat", jumpChain, o.GetCustomNatJumpRules(natChain))
+	add("nat", "OUTPUT", o.GetCustomNatLocalJumpRules(natChain))
+	if o.Opts.ChainLogging {
+		add("nat", jumpChain, [][]string{o.GetLogJumpRule(jumpChain)})
+	}
+	add("nat", natChain, o.chainRules())
+
+	if o.Opts.LBMode == "hash" {
+		add("mangle", o.hashMangleChain(), o.GetHashMarkRules())
+	}
+
+	if o.hasFilterRules() {
+		filterChain := o.GetChainName("filter")
+		for _, c := range o.limitFilterChains() {
+			add("filter", c, o.GetLimitJumpRules(filterChain))
+		}
+		add("filter", filterChain, o.limitRules())
+	}
+
+	return rules
+}
+
+// taggedRules returns the rules of every table in the current network namespace
+// that are tagged with operator.Opts.Profile
+func (o *Operator) taggedRules() ([]taggedRule, error) {
+	var rules []taggedRule
+
+	for _, t := range Tables {
+		chains, err := o.IPT.ListChains(t)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range chains {
+			listed, err := o.iptList(t, c)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, r := range listed {
+				rule := SplitRule(r)
+				_, p, ok := o.ruleTag(rule)
+				if !ok || p != o.Opts.Profile {
+					continue
+				}
+				rules = append(rules, taggedRule{Table: t, Chain: c, Rule: rule[2:]})
+			}
+		}
+	}
+
+	return rules, nil
+}
+
+// createdForms returns the rules listed by iptables -S in table t/chain c in the
+// form that operator.Opts.Profile creates them, so the records of removed rules
+// pair with the records of a later add (see newResult). A listed rule takes the
+// form of a profile rule with the same tag when iptables has a rule of that form.
+// Any other rule keeps its listed form
+func (o *Operator) createdForms(t, c string, listed [][]string) ([][]string, error) {
+	// The rule builders target other chains, so the target of the caller is put back
+	defer o.Target(o.Opts.Table, o.Opts.Chain)
+
+	created := make(map[string][][]string)
+	for _, r := range o.profileRules() {
+		if r.Table == t && r.Chain == c {
+			created[r.key()] = append(created[r.key()], r.Rule)
+		}
+	}
+
+	forms := make([][]string, len(listed))
+	for i, r := range listed {
+		forms[i] = r
+		if ruleArg(r, "--comment") == "" {
+			continue
+		}
+
+		key := taggedRule{Table: t, Chain: c, Rule: r}.key()
+		for j, f := range created[key] {
+			exists, err := o.iptExists(t, c, f...)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				forms[i] = f
+				created[key] = append(created[key][:j:j], created[key][j+1:]...)
+				break
+			}
+		}
+	}
+
+	return forms, nil
+}
+
+// removeTaggedRules removes the rules tagged with operator.Opts.Profile from the
+// chains that iptlb does not own. The rules of the iptlb chains go with the chains
+func (o *Operator) removeTaggedRules() error {
+	rules, err := o.taggedRules()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rules {
+		if strings.HasPrefix(r.Chain, o.chainPrefix()) {
+			continue
+		}
+
+		forms, err := o.createdForms(r.Table, r.Chain, [][]string{r.Rule})
+		if err != nil {
+			return err
+		}
+
+		err = o.Target(r.Table, r.Chain).RemoveRule(forms[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/ulfox/iptlb/utils"
+)
+
+// isRedirect returns true if destination d is on the local host and the rules
+// backend captures the traffic in PREROUTING (proxy/server). Loopback destinations
+// and destinations on the profile's own source address are reached with REDIRECT,
+// since DNAT to a loopback address is dropped as martian in PREROUTING
+func (o *Operator) isRedirect(d string) bool {
+	if o.Opts.RulesType == "client" {
+		return false
+	}
+
+	ip := net.ParseIP(strings.Split(d, ":")[0])
+	if ip == nil {
+		return false
+	}
+
+	return ip.IsLoopback() || ip.Equal(net.ParseIP(strings.Split(o.Opts.Src, ":")[0]))
+}
+
+// targets returns every DNAT target of the profile: operator.Opts.Dest,
+// operator.Opts.BackupDest and operator.Opts.FallbackDest
+func (o *Operator) targets() []string {
+	targets := append(append([]string{}, o.Opts.Dest...), o.Opts.BackupDest...)
+	if o.Opts.FallbackDest == "" {
+		return targets
+	}
+	return append(targets, o.Opts.FallbackDest)
+}
+
+// CheckTargets validates the rules backend and the combination of backend,
+// source and destinations before any rule is written.
+// Method uses operator.Opts.RulesType, operator.Opts.Src, operator.Opts.Dest & operator.Opts.FallbackDest
+func (o *Operator) CheckTargets() error {
+	err := utils.CheckRulesBackend(o.Opts.RulesType)
+	if err != nil {
+		return err
+	}
+
+	for _, j := range o.targets() {
+		ip := net.ParseIP(strings.Split(j, ":")[0])
+		if ip != nil && ip.IsUnspecified() {
+			return fmt.Errorf("destination [%s] is not valid. Unspecified addresses can not be used as DNAT targets", j)
+		}
+	}
+
+	if o.Opts.RulesType != "server" || !o.Opts.CreateRules {
+		return nil
+	}
+
+	// The server backend only captures packets sent to a local address
+	src := strings.Split(o.Opts.Src, ":")[0]
+	local, err := utils.IsLocalAddress(src)
+	if err != nil {
+		return err
+	}
+	if !local {
+		return fmt.Errorf(
+			"source [%s] is not an address of this host. Rules backend [server] "+
+				"can only capture traffic sent to a local address. Use [proxy] instead",
+			o.Opts.Src,
+		)
+	}
+
+	return nil
+}
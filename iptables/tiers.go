@@ -0,0 +1,146 @@
+package iptables
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	ipte "github.com/ulfox/iptlb/utils/logs"
+)
+
+// Destination tiers of a profile. Only one tier is in the custom nat chain
+const (
+	PrimaryTier = 0
+	BackupTier  = 1
+)
+
+// tiers returns the destinations of each tier, highest priority first
+func (o *Operator) tiers() [][]string {
+	return [][]string{o.Opts.Dest, o.Opts.BackupDest}
+}
+
+// activeDest returns the destinations of operator.Opts.ActiveTier, which are
+// the destinations the custom nat chain balances
+func (o *Operator) activeDest() []string {
+	if o.Opts.ActiveTier == BackupTier && len(o.Opts.BackupDest) > 0 {
+		return o.Opts.BackupDest
+	}
+	return o.Opts.Dest
+}
+
+// healthy returns true if destination d accepts connections. Only tcp
+// destinations can be probed, others are always considered healthy.
+// The probe runs in the current network namespace (see SetNetns)
+func (o *Operator) healthy(d string) bool {
+	if o.Opts.Protocol != "tcp" {
+		return true
+	}
+
+	conn, err := net.DialTimeout("tcp", d, o.Opts.HealthTimeout)
+	if err != nil {
+		o.Logger.WithFields(logrus.Fields{
+			"Stage":       "healthCheck",
+			"Profile":     o.Opts.Profile,
+			"Destination": d,
+		}).Warn(err)
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+// selectTier returns the highest tier with at least one healthy destination.
+// Profiles without backup destinations and profiles where no destination is
+// healthy use the primary tier
+func (o *Operator) selectTier() int {
+	if len(o.Opts.BackupDest) == 0 {
+		return PrimaryTier
+	}
+
+	for i, t := range o.tiers() {
+		for _, d := range t {
+			if o.healthy(d) {
+				return i
+			}
+		}
+	}
+
+	return PrimaryTier
+}
+
+// tierName returns the name of tier t for logging
+func tierName(t int) string {
+	if t == BackupTier {
+		return "backup"
+	}
+	return "primary"
+}
+
+// Failover method checks the destinations of operator.Opts.Profile and, if the active
+// tier is no longer the highest healthy tier, replaces the custom nat chain atomically
+// with the rules of the new tier and records the new active tier in the state.
+// Only a tier switch is recorded in the audit log
+func (o *Operator) Failover() error {
+	log := o.Logger.WithFields(logrus.Fields{
+		"Stage":   "Failover",
+		"Profile": o.Opts.Profile,
+	})
+
+	if !o.Opts.CreateRules {
+		return fmt.Errorf("failover requires -run")
+	}
+
+	err := o.loadProfile()
+	if err != nil {
+		return err
+	}
+	if len(o.Opts.BackupDest) == 0 || !o.Opts.Enabled {
+		return nil
+	}
+
+	err = o.SetNetns()
+	if err != nil {
+		return err
+	}
+
+	tier := o.selectTier()
+	if tier == o.Opts.ActiveTier {
+		log.WithField("Tier", tierName(tier)).Info(ipte.InfoTierUnchanged)
+		return nil
+	}
+
+	return o.audit("failover", func() error {
+		o.Target("nat", o.GetChainName("nat"))
+		exists, err := o.iptChainExists(o.Opts.Table, o.Opts.Chain)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf(ipte.ErrChainNotApplied, o.Opts.Table, o.Opts.Chain, o.Opts.Profile)
+		}
+
+		oldRules := o.chainRules()
+		o.Opts.ActiveTier = tier
+		newRules := o.chainRules()
+
+		err = o.ReplaceChain(newRules)
+		if err != nil {
+			return err
+		}
+		o.recordReplace(oldRules, newRules)
+
+		err = o.Storage.AddActiveTier(o.Opts.Profile, tier)
+		if err != nil {
+			return err
+		}
+
+		log.WithFields(logrus.Fields{
+			"Tier":         tierName(tier),
+			"Destinations": strings.Join(o.activeDest(), ","),
+		}).Info(ipte.InfoTierSwitched)
+
+		return nil
+	})
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"runtime"
 	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/ulfox/iptlb/iptables"
 	"github.com/ulfox/iptlb/utils"
+	ipte "github.com/ulfox/iptlb/utils/logs"
 )
 
+func init() {
+	// iptlb switches network namespaces per profile (see Operator.SetNetns).
+	// Namespaces belong to threads, so the main goroutine must keep its thread
+	runtime.LockOSThread()
+}
+
 func main() {
 	srcAddr := flag.String("src-addr", "", "The source socket address (ipv4:port) we want to route")
 	destAddr := flag.String("dest-addr", "", "Comma-separated list of destination socket addresses (ipv4:port) for the target routes")
-	rulesBackend := flag.String("rules-backend", "client", "[client/proxy/server] (Client) If ip tables are applied on the client host. If they are not, set this to (proxy) to apply rules in PREROUTING or (server) to apply rules in INPUT")
+	rulesBackend := flag.String("rules-backend", "client", "[client/proxy/server] (Client) If ip tables are applied on the client host. If they are not, set this to (proxy) to apply rules in PREROUTING or (server) to capture traffic sent to a local address in PREROUTING")
 	setProfile := flag.String("profile", "default", "The profile name for the rules. Each profile can use a different set or combination of src/dest options")
 	resetProfile := flag.Bool("reset", false, "Reset the given profile. Warning: This option removes the IPTable rules also")
 	deleteProfile := flag.Bool("delete", false, "Delete the given profile. Warning: This option removes the IPTable rules also")
@@ -22,9 +33,49 @@ func main() {
 	logLevel := flag.String("log-level", "4", "The log level when log-custom-chain is enabled.")
 	protocol := flag.String("protocol", "tcp", "The protocol that will be used for the rules. Default tcp")
 	run := flag.Bool("run", false, "By default IPTLB will write the rules to a local storage but will not create them. Pass this flag to also enable the rules")
+	drain := flag.Bool("drain", false, "Drain the removed destinations on -delete or dest remove. New connections stop at once and the conntrack entries are deleted once the connections reach zero or -drain-grace has passed")
+	drainGrace := flag.Duration("drain-grace", 30*time.Second, "The grace period that -drain waits for the connections of a removed destination to finish")
+	force := flag.Bool("force", false, "Used with -drain. Delete the conntrack entries of the removed destinations immediately")
+	outputLogFormat := flag.String("output-log-format", "text", "[json/text] The format of iptlb's own log output")
+	verbosity := flag.String("verbosity", "info", "[debug/info/warn/error] The verbosity of iptlb's own log output")
+	clientCIDR := flag.String("client-cidr", "", "Comma-separated list of client cidrs that are load balanced. Prefix a cidr with ! to exclude it (e.g. 10.20.0.0/16,!10.20.5.0/24). Default all clients")
+	inInterface := flag.String("in-interface", "", "Only balance packets arriving on this interface (proxy/server backends). A trailing + is a wildcard, e.g. eth+")
+	outInterface := flag.String("out-interface", "", "Only balance packets leaving on this interface (client backend). A trailing + is a wildcard, e.g. eth+")
+	preflightChecks := flag.Bool("preflight", false, "Run the iptlb doctor checks of a profile before applying it and refuse to apply it if any check fails")
+	netnsPath := flag.String("netns", "", "Apply the profile inside the network namespace at this path (e.g. /var/run/netns/foo). Default the namespace iptlb runs in")
+	netnsPID := flag.Int("netns-pid", 0, "Apply the profile inside the network namespace of this process. Incompatible with -netns")
+	lbMode := flag.String("lb-mode", "random", "[random/hash] (random) Spread connections randomly over the destinations or (hash) map each client address to the same destination using HMARK")
+	hashPort := flag.Bool("hash-port", false, "Used with -lb-mode=hash. Hash the client port together with the client address")
+	rateLimit := flag.String("rate-limit", "", "Limit the rate of new connections to the source, e.g. 100/second. Default no limit")
+	rateLimitKey := flag.String("rate-limit-key", "client", "[client/global] (client) Apply -rate-limit to each client address or (global) to all clients together")
+	rateLimitBurst := flag.Int("rate-limit-burst", 0, "The burst of new connections allowed above -rate-limit. Default the hashlimit default (5)")
+	maxConnsPerDest := flag.Int("max-conns-per-dest", 0, "The maximum concurrent connections sent to each destination. Default no limit")
+	limitAction := flag.String("limit-action", "drop", "[drop/reject] What to do with connections that exceed -rate-limit or -max-conns-per-dest")
+	fallbackDest := flag.String("fallback-dest", "", "A destination socket address (ipv4:port) that gets the connections when the profile has no destinations or all of them are full")
+	fallback := flag.String("fallback", "", "[reject] Reject the connections (tcp gets a reset) when the profile has no destinations or all of them are full. Incompatible with -fallback-dest")
+	backupDest := flag.String("backup-dest", "", "Comma-separated list of backup destination socket addresses (ipv4:port). They are only balanced when no -dest-addr destination accepts connections (see iptlb failover)")
+	healthTimeout := flag.Duration("health-timeout", 2*time.Second, "The timeout of the tcp connect that checks if a destination is healthy. Used with -backup-dest")
+	labels := flag.String("label", "", "Comma-separated list of key=value labels stored in the profile, e.g. team=payments,env=prod")
+	selector := flag.String("selector", "", "Comma-separated list of label requirements (key=value, key!=value, key, !key). Used with -use-state, -delete, -reset, list and status to act only on the matching profiles")
+	ttl := flag.Duration("ttl", 0, "Expire the profile after this duration, e.g. 2h. Expired profiles are deleted by iptlb gc. Default never")
+	expiresAt := flag.String("expires-at", "", "Expire the profile at this time (RFC3339, e.g. 2006-01-02T15:04:05Z). Incompatible with -ttl")
+	gcInterval := flag.Duration("gc-interval", 0, "Used with iptlb gc. Keep running and collect garbage at this interval until iptlb is stopped. Default run once")
+	orphans := flag.Bool("orphans", false, "Used with iptlb gc. Also remove the IPTLB chains and rules that no profile of the state owns")
+	output := flag.String("output", "text", "[text/json] With json, a single result document with the changed flag and the chains & rules that were created, deleted or left untouched is written to stdout")
+	detailedExitCode := flag.Bool("detailed-exitcode", false, "Exit with 0 when nothing changed, 2 when something changed and 1 on error")
+	revisions := flag.Int("revisions", 10, "Keep this many revisions of each profile in the state, see iptlb rollback. 0 disables the revisions")
+	toRevision := flag.Int("to-revision", 0, "Used with iptlb rollback. The revision to roll back to. Default the revision before the latest one")
+	backupRetention := flag.Int("backup-retention", 10, "Keep this many backups of the iptables tables and the state, taken before every change that -run makes. 0 disables the backups")
+	chainPrefix := flag.String("chain-prefix", "", "The prefix of the chains and LOG rules of this iptlb instance (1-8 upper-case alphanumerics). Stored in the state file header. Default IPTLB")
+	flag.String("config", utils.IPTLBConfigPath, "The global config file. Its settings are flag names, e.g. state-file: /var/lib/iptlb/state.db. Flags and IPTLB_* environment variables take precedence over it")
 	useState := flag.Bool("use-state", false, "Requires also -run. Incompatible with -src-addr && -dest-addr. When enabled along with -run, IPTLB will use the state file to read all profiles and apply them")
 
-	flag.Parse()
+	args := parseArgs()
+
+	settings, issues, err := loadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	operatorOpts := &iptables.OperatorOpts{
 		Src:          *srcAddr,
@@ -39,79 +90,144 @@ func main() {
 		LogLevel:     *logLevel,
 		CreateRules:  *run,
 		UseState:     *useState,
+		Drain:        *drain || *force,
+		DrainForce:   *force,
+		DrainGrace:   *drainGrace,
+		InInterface:  *inInterface,
+		OutInterface: *outInterface,
+		Preflight:    *preflightChecks,
+		LBMode:       *lbMode,
+		HashPort:     *hashPort,
+
+		RateLimit:       *rateLimit,
+		RateLimitKey:    *rateLimitKey,
+		RateLimitBurst:  *rateLimitBurst,
+		MaxConnsPerDest: *maxConnsPerDest,
+		LimitAction:     *limitAction,
+		FallbackDest:    *fallbackDest,
+		Fallback:        *fallback,
+		HealthTimeout:   *healthTimeout,
+		Selector:        *selector,
+		ExpiresAt:       *expiresAt,
+		Prefix:          *chainPrefix,
+		BackupRetention: *backupRetention,
+		Revisions:       *revisions,
 	}
 
 	if *destAddr != "" {
 		operatorOpts.Dest = strings.Split(*destAddr, ",")
 	}
 
-	if (operatorOpts.Src != "" || len(operatorOpts.Dest) != 0) && *useState {
+	labelMap, err := utils.ParseLabels(*labels)
+	if err != nil {
+		log.Fatal(err)
+	}
+	operatorOpts.Labels = labelMap
+
+	if *ttl != 0 && *expiresAt != "" {
+		log.Fatal("-ttl is incompatible with -expires-at")
+	}
+	if *ttl < 0 {
+		log.Fatal("-ttl can not be negative")
+	}
+	if *ttl != 0 {
+		operatorOpts.ExpiresAt = time.Now().Add(*ttl).UTC().Format(time.RFC3339)
+		operatorOpts.TTL = *ttl
+	}
+
+	if *backupDest != "" {
+		operatorOpts.BackupDest = strings.Split(*backupDest, ",")
+	}
+
+	if *netnsPath != "" && *netnsPID != 0 {
+		log.Fatal("-netns is incompatible with -netns-pid")
+	}
+	operatorOpts.Netns = *netnsPath
+	if *netnsPID != 0 {
+		// Pids do not survive restarts, the profile keeps a pinned path instead. The
+		// namespace is pinned once the profile passed the checks (see Operator.Configure)
+		if !*run {
+			log.Fatal("-netns-pid requires -run also. The pid may be gone by the time the profile is applied")
+		}
+		operatorOpts.Netns = utils.ProcNetns(*netnsPID)
+		operatorOpts.NetnsPID = *netnsPID
+	}
+
+	if *clientCIDR != "" {
+		operatorOpts.ClientCIDR = strings.Split(*clientCIDR, ",")
+	}
+
+	if (operatorOpts.Src != "" || len(operatorOpts.Dest) != 0 || len(operatorOpts.BackupDest) != 0) && *useState {
 		log.Fatal("-use-state is incompatible with -src-addr && -dest-addr")
 	}
 
+	bulk := *useState || *selector != ""
+	if *selector != "" && len(args) == 0 && !*useState && !operatorOpts.Delete && !operatorOpts.Reset {
+		log.Fatal("-selector requires -use-state, -delete or -reset")
+	}
+	if (operatorOpts.Src != "" || len(operatorOpts.Dest) != 0) && *selector != "" {
+		log.Fatal("-selector is incompatible with -src-addr && -dest-addr")
+	}
+
 	if operatorOpts.Delete && !*run {
 		log.Fatal("delete requires -run also. This is to avoid removing the state and leave lefovers in the iptables")
 	}
 
-	logger := logrus.New()
+	if *output != "text" && *output != "json" {
+		log.Fatal(fmt.Errorf(ipte.ErrOutput, *output))
+	}
+	report := &iptables.Report{}
+	operatorOpts.Report = report
+
+	logger, err := ipte.NewLogger(*outputLogFormat, *verbosity)
+	if err != nil {
+		log.Fatal(err)
+	}
 	log := logger.WithFields(logrus.Fields{
 		"Prog":      "iptlb",
 		"Component": "main",
 	})
 	log.Info("Initiating")
-	iptlbEnv := utils.GetIPTLBEnv(utils.IPTLBPrefix)
-	log.Info(iptlbEnv)
+	for _, j := range issues.unknownEnv {
+		log.WithField("Env", j).Warn(ipte.WarnUnknownEnv)
+	}
+	if issues.unreadable != nil {
+		log.WithError(issues.unreadable).Warn(ipte.WarnConfigUnreadable)
+	}
+
+	// finish writes the report and exits with the exit code of the run
+	finish := func(err error) {
+		if *output == "json" && !(len(args) > 0 && printCommands[args[0]]) {
+			werr := report.Write(os.Stdout, err)
+			if werr != nil {
+				log.Error(werr)
+			}
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *detailedExitCode && report.Changed() {
+			os.Exit(2)
+		}
+		os.Exit(0)
+	}
+
+	if len(args) > 0 {
+		finish(runCommand(args, operatorOpts, logger, gcOpts{Interval: *gcInterval, Orphans: *orphans}, *toRevision, settings))
+	}
 
 	operator, err := iptables.NewOperatorFactory(operatorOpts, logger)
 	if err != nil {
-		log.Fatal(err)
+		finish(err)
 	}
 	log.Info("db operator initiated")
 
-	if operator.Opts.Src == "" && len(operator.Opts.Dest) == 0 && *useState {
-		data := operator.Storage.GetData()
-		for k := range data.(map[interface{}]interface{}) {
-			key, ok := k.(string)
-			if !ok {
-				log.Fatalf("possibly corrupted key in db [%s]", k)
-			}
-			operatorOpts.Profile = key
-
-			// We now get the src & dest addresses from each profile
-			err = operator.GetStateSrc()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = operator.GetStateDest()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = operator.GetStateProtocol()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = operator.GetStateLogLevel()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = operator.GetStateLogEnabled()
-			if err != nil {
-				log.Fatal(err)
-			}
-			err = operator.GetStateRulesBackend()
-			if err != nil {
-				log.Fatal(err)
-			}
-
-			err = operator.Configure()
-			if err != nil {
-				log.Fatal(err)
-			}
+	if operator.Opts.Src == "" && len(operator.Opts.Dest) == 0 && bulk {
+		results, err := operator.Replay()
+		if err != nil {
+			finish(err)
 		}
-		return
-	}
-	err = operator.Configure()
-	if err != nil {
-		log.Fatal(err)
+		finish(summarizeReplay(results, *output == "text"))
 	}
+	finish(operator.Configure())
 }
@@ -0,0 +1,273 @@
+package preflight
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var (
+	// ProcPath is the mount point of procfs
+	ProcPath = "/proc"
+
+	// ModulesPath is the directory that holds the kernel modules of all kernel releases
+	ModulesPath = "/lib/modules"
+
+	// IPTablesCmd is the iptables binary whose variant (legacy/nf_tables) is checked
+	IPTablesCmd = "iptables"
+
+	// HostModules are the modules that iptlb doctor checks once for the host,
+	// whatever features the profiles use
+	HostModules = []string{"xt_recent"}
+)
+
+// Requirements that a profile has on the host
+type Requirements struct {
+	Forwarding    bool
+	RouteLocalnet bool
+	Modules       []string
+}
+
+// Result of a single check. Hint tells how to fix a failed check
+type Result struct {
+	Check   string
+	Passed  bool
+	Message string
+	Hint    string
+}
+
+// Run checks every requirement of r
+func Run(r Requirements) []Result {
+	var results []Result
+
+	if r.Forwarding {
+		results = append(results, checkSysctl(
+			"net.ipv4.ip_forward",
+			"1",
+			"required to forward the DNATed packets to other hosts",
+		))
+	}
+
+	if r.RouteLocalnet {
+		results = append(results, checkSysctl(
+			"net.ipv4.conf.all.route_localnet",
+			"1",
+			"required to DNAT to loopback destinations",
+		))
+	}
+
+	for _, m := range r.Modules {
+		results = append(results, checkModule(m))
+	}
+
+	return results
+}
+
+// Failed returns the results that did not pass
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, j := range results {
+		if !j.Passed {
+			failed = append(failed, j)
+		}
+	}
+
+	return failed
+}
+
+func checkSysctl(key, want, reason string) Result {
+	result := Result{
+		Check: fmt.Sprintf("sysctl %s=%s", key, want),
+		Hint:  fmt.Sprintf("sysctl -w %s=%s (persist it under /etc/sysctl.d)", key, want),
+	}
+
+	path := filepath.Join(ProcPath, "sys", strings.Replace(key, ".", "/", -1))
+	value, err := ioutil.ReadFile(path)
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	got := strings.TrimSpace(string(value))
+	result.Passed = got == want
+	result.Message = fmt.Sprintf("%s is %s, %s", key, got, reason)
+
+	return result
+}
+
+func checkModule(name string) Result {
+	result := Result{
+		Check: fmt.Sprintf("kernel module %s", name),
+		Hint:  fmt.Sprintf("modprobe %s (persist it under /etc/modules-load.d)", name),
+	}
+
+	loaded, err := moduleLoaded(name)
+	if os.IsNotExist(err) {
+		// Without /proc/modules the kernel has no loadable module support,
+		// every netfilter feature it has is built in
+		result.Passed = true
+		result.Message = "kernel without loadable module support, assuming built in"
+		return result
+	}
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+	if loaded {
+		result.Passed = true
+		result.Message = "loaded"
+		return result
+	}
+
+	release, err := kernelRelease()
+	if err != nil {
+		result.Message = err.Error()
+		return result
+	}
+
+	dir := filepath.Join(ModulesPath, release)
+	if listed(filepath.Join(dir, "modules.builtin"), name) {
+		result.Passed = true
+		result.Message = "built into the kernel"
+		return result
+	}
+	if listed(filepath.Join(dir, "modules.dep"), name) {
+		result.Passed = true
+		result.Message = "available, loaded on demand"
+		return result
+	}
+
+	result.Message = fmt.Sprintf("not loaded and not available for kernel %s", release)
+	return result
+}
+
+func moduleLoaded(name string) (bool, error) {
+	f, err := os.Open(filepath.Join(ProcPath, "modules"))
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if strings.SplitN(scanner.Text(), " ", 2)[0] == name {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// listed returns true if module name is listed in a modules.builtin or
+// modules.dep file. Module names use _ and - interchangeably
+func listed(path, name string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	want := strings.Replace(name, "-", "_", -1)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		module := filepath.Base(strings.SplitN(scanner.Text(), ":", 2)[0])
+		module = strings.SplitN(module, ".ko", 2)[0]
+		if strings.Replace(module, "-", "_", -1) == want {
+			return true
+		}
+	}
+
+	return false
+}
+
+func kernelRelease() (string, error) {
+	var uts syscall.Utsname
+	err := syscall.Uname(&uts)
+	if err != nil {
+		return "", err
+	}
+
+	var release strings.Builder
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release.WriteByte(byte(c))
+	}
+
+	return release.String(), nil
+}
+
+// CheckIPTablesBackend checks that the rules are not split between the legacy
+// and the nf_tables iptables variants. The variant of the iptables binary that
+// iptlb uses must be the only one that holds chains with prefix p (e.g. IPTLB_)
+func CheckIPTablesBackend(p string) Result {
+	result := Result{
+		Check: "iptables variant",
+		Hint: "use a single iptables variant on the host " +
+			"(update-alternatives --set iptables ...) and remove the IPTLB chains from the other one",
+	}
+
+	out, err := exec.Command(IPTablesCmd, "--version").Output()
+	if err != nil {
+		result.Message = fmt.Sprintf("%s --version: %s", IPTablesCmd, err)
+		return result
+	}
+
+	version := strings.TrimSpace(string(out))
+	other := "iptables-nft-save"
+	if strings.Contains(version, "nf_tables") {
+		other = "iptables-legacy-save"
+	}
+
+	result.Passed = true
+	result.Message = version
+
+	// Listing the other variant loads its kernel modules when they are not
+	// loaded yet. Without them, it can not hold any chain
+	if !otherVariantLoaded(other) {
+		return result
+	}
+
+	saved, err := exec.Command(other, "-t", "nat").Output()
+	if err != nil {
+		// The other variant is not installed or not usable
+		return result
+	}
+
+	if strings.Contains(string(saved), ":"+p) {
+		result.Passed = false
+		result.Message = fmt.Sprintf("%s, but %s also lists %s chains", version, other, p)
+	}
+
+	return result
+}
+
+// otherVariantLoaded reports if the kernel side of the iptables variant of save
+// command other is loaded: the legacy nat table, listed in ip_tables_names, or
+// the nf_tables module. A kernel without module support has nf_tables built in
+func otherVariantLoaded(other string) bool {
+	if other == "iptables-legacy-save" {
+		names, err := ioutil.ReadFile(filepath.Join(ProcPath, "net", "ip_tables_names"))
+		if err != nil {
+			return false
+		}
+		for _, j := range strings.Fields(string(names)) {
+			if j == "nat" {
+				return true
+			}
+		}
+		return false
+	}
+
+	loaded, err := moduleLoaded("nf_tables")
+	if os.IsNotExist(err) {
+		return true
+	}
+	return loaded
+}
@@ -0,0 +1,148 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RuleRecord describes a single iptables rule that iptlb added or removed
+type RuleRecord struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+	Rule  string `json:"rule"`
+}
+
+// ChainRecord describes a single iptables chain that iptlb created or deleted
+type ChainRecord struct {
+	Table string `json:"table"`
+	Chain string `json:"chain"`
+}
+
+// RuleChanges keeps track of the rules and chains that were added or removed
+// during an operation. The rules and chains that were already in place are
+// kept for the result of the operation but are not part of the audit log
+type RuleChanges struct {
+	Added           []RuleRecord  `json:"rulesAdded"`
+	Removed         []RuleRecord  `json:"rulesRemoved"`
+	Unchanged       []RuleRecord  `json:"-"`
+	ChainsCreated   []ChainRecord `json:"chainsCreated,omitempty"`
+	ChainsDeleted   []ChainRecord `json:"chainsDeleted,omitempty"`
+	ChainsUnchanged []ChainRecord `json:"-"`
+	TablesRestored  []string      `json:"tablesRestored,omitempty"`
+}
+
+// Changed reports if any rule, chain or table was changed
+func (c RuleChanges) Changed() bool {
+	return len(c.Added) > 0 ||
+		len(c.Removed) > 0 ||
+		len(c.ChainsCreated) > 0 ||
+		len(c.ChainsDeleted) > 0 ||
+		len(c.TablesRestored) > 0
+}
+
+// AuditEntry is a single line of the audit log. Each entry records who
+// changed a profile, when, and what the change was
+type AuditEntry struct {
+	Timestamp time.Time              `json:"timestamp"`
+	User      string                 `json:"user"`
+	UID       string                 `json:"uid"`
+	SudoUser  string                 `json:"sudoUser,omitempty"`
+	Hostname  string                 `json:"hostname"`
+	Flags     []string               `json:"flags"`
+	Profile   string                 `json:"profile"`
+	Action    string                 `json:"action"`
+	Before    map[string]interface{} `json:"before"`
+	After     map[string]interface{} `json:"after"`
+	Error     string                 `json:"error,omitempty"`
+	RuleChanges
+}
+
+// AuditPath returns the audit log path that belongs to a state file.
+// For local/state.db that is local/state.audit.jsonl
+func AuditPath(statePath string) string {
+	ext := filepath.Ext(statePath)
+	return fmt.Sprintf("%s.audit.jsonl", strings.TrimSuffix(statePath, ext))
+}
+
+// NewAuditEntry creates an audit entry for a profile action and fills in
+// the timestamp, the invoking user, the hostname and the command-line flags
+func NewAuditEntry(profile, action string) *AuditEntry {
+	entry := &AuditEntry{
+		Timestamp: time.Now().UTC(),
+		Profile:   profile,
+		Action:    action,
+		Flags:     os.Args[1:],
+		SudoUser:  os.Getenv("SUDO_USER"),
+	}
+
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+		entry.UID = u.Uid
+	} else {
+		entry.UID = fmt.Sprintf("%d", os.Getuid())
+	}
+
+	if h, err := os.Hostname(); err == nil {
+		entry.Hostname = h
+	}
+
+	return entry
+}
+
+// AppendAudit writes an entry as a new line at the end of the audit log
+func AppendAudit(path string, e *AuditEntry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// ReadAudit reads the audit log. When profile is not empty, only the
+// entries of that profile are returned. A missing log is not an error
+func ReadAudit(path, profile string) ([]AuditEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []AuditEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var entry AuditEntry
+		err := json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, fmt.Errorf("audit log [%s] line [%d]: %s", path, n, err)
+		}
+
+		if profile != "" && entry.Profile != profile {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
@@ -0,0 +1,246 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// backupIDFormat is the timestamp format of the backup ids. Ids sort in the
+// order the backups were taken
+const backupIDFormat = "20060102T150405Z"
+
+// Backup describes a snapshot of the iptables tables that iptlb was about to
+// change and of the state file, taken before the change
+type Backup struct {
+	ID        string    `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+	Action    string    `json:"action"`
+	Profile   string    `json:"profile"`
+	Netns     string    `json:"netns"`
+	Tables    []string  `json:"tables"`
+}
+
+// BackupsPath returns the backups directory that belongs to a state file.
+// For local/state.db that is local/state.backups
+func BackupsPath(statePath string) string {
+	ext := filepath.Ext(statePath)
+	return fmt.Sprintf("%s.backups", strings.TrimSuffix(statePath, ext))
+}
+
+// SaveBackup writes a backup to a new directory under dir: the iptables-save
+// output of each table of tables, the state file content and the metadata.
+// The id of b is set from its timestamp
+func SaveBackup(dir string, b *Backup, tables map[string][]byte, state []byte) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	id := b.Timestamp.UTC().Format(backupIDFormat)
+	b.ID = id
+	for i := 1; ; i++ {
+		err = os.Mkdir(filepath.Join(dir, b.ID), 0700)
+		if !os.IsExist(err) {
+			break
+		}
+		b.ID = fmt.Sprintf("%s-%d", id, i)
+	}
+	if err != nil {
+		return err
+	}
+
+	b.Tables = b.Tables[:0]
+	for t, data := range tables {
+		err = ioutil.WriteFile(filepath.Join(dir, b.ID, fmt.Sprintf("%s.rules", t)), data, 0600)
+		if err != nil {
+			return err
+		}
+		b.Tables = append(b.Tables, t)
+	}
+	sort.Strings(b.Tables)
+
+	err = ioutil.WriteFile(filepath.Join(dir, b.ID, "state.db"), state, 0600)
+	if err != nil {
+		return err
+	}
+
+	meta, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filepath.Join(dir, b.ID, "backup.json"), meta, 0600)
+}
+
+// ListBackups returns the backups under dir, oldest first. A missing
+// directory is not an error
+func ListBackups(dir string) ([]Backup, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, j := range entries {
+		if !j.IsDir() {
+			continue
+		}
+
+		b, err := ReadBackup(dir, j.Name())
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, *b)
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		if backups[i].Timestamp.Equal(backups[j].Timestamp) {
+			return backups[i].ID < backups[j].ID
+		}
+		return backups[i].Timestamp.Before(backups[j].Timestamp)
+	})
+
+	return backups, nil
+}
+
+// ReadBackup reads the metadata of backup id under dir
+func ReadBackup(dir, id string) (*Backup, error) {
+	if id == "" || strings.ContainsAny(id, `/\`) || id == "." || id == ".." {
+		return nil, fmt.Errorf("backup id [%s] is not valid", id)
+	}
+
+	meta, err := ioutil.ReadFile(filepath.Join(dir, id, "backup.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("backup [%s] does not exist in [%s]", id, dir)
+		}
+		return nil, err
+	}
+
+	b := &Backup{}
+	err = json.Unmarshal(meta, b)
+	if err != nil {
+		return nil, fmt.Errorf("backup [%s] is corrupted: %s", id, err)
+	}
+
+	return b, nil
+}
+
+// ReadBackupTable returns the iptables-save output of table t in backup b
+func ReadBackupTable(dir string, b *Backup, t string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(dir, b.ID, fmt.Sprintf("%s.rules", t)))
+}
+
+// ReadBackupState returns the state file content of backup b
+func ReadBackupState(dir string, b *Backup) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(dir, b.ID, "state.db"))
+}
+
+// PruneBackups removes the oldest backups under dir until keep are left and
+// returns the ids of the removed backups
+func PruneBackups(dir string, keep int) ([]string, error) {
+	backups, err := ListBackups(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var removed []string
+	for i := 0; i < len(backups)-keep; i++ {
+		err = os.RemoveAll(filepath.Join(dir, backups[i].ID))
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, backups[i].ID)
+	}
+
+	return removed, nil
+}
+
+// Snapshot returns the content of the state file
+func (d *DB) Snapshot() ([]byte, error) {
+	return ioutil.ReadFile(d.Storage.Path)
+}
+
+// ReplaceState replaces the content of the state file with data and reloads it
+func (d *DB) ReplaceState(data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(d.Storage.Path), ".tx.*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = os.Rename(f.Name(), d.Storage.Path)
+	if err != nil {
+		return err
+	}
+
+	return d.Storage.Read()
+}
+
+// RestoreNetnsState puts back the profiles of network namespace ns from the state
+// file content data: profiles of ns that data does not have are deleted and the
+// ones it has replace the current ones. The profiles of other namespaces and the
+// header are kept, since a backup holds the tables of a single namespace
+func (d *DB) RestoreNetnsState(data []byte, ns string) error {
+	var saved map[interface{}]interface{}
+	err := yaml.Unmarshal(data, &saved)
+	if err != nil {
+		return err
+	}
+
+	current, ok := d.Storage.GetData().(map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("state [%s] is not a map of profiles", d.Storage.Path)
+	}
+
+	inNetns := func(k, v interface{}) bool {
+		if k == HeaderKey {
+			return false
+		}
+		profile, _ := v.(map[interface{}]interface{})
+		netns, _ := profile["netns"].(string)
+		return netns == ns
+	}
+
+	restored := make(map[interface{}]interface{}, len(current))
+	for k, v := range current {
+		if !inNetns(k, v) {
+			restored[k] = v
+		}
+	}
+	for k, v := range saved {
+		// A profile that moved to another namespace since keeps its current state
+		if _, ok := restored[k]; !ok && inNetns(k, v) {
+			restored[k] = v
+		}
+	}
+
+	out, err := yaml.Marshal(restored)
+	if err != nil {
+		return err
+	}
+
+	return d.ReplaceState(out)
+}
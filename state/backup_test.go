@@ -0,0 +1,87 @@
+package state
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRestoreNetnsState(t *testing.T) {
+	d, err := NewStateFactory(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	add := func(p, src, ns string) {
+		if err := d.AddSource(p, src, SourceMatch{Netns: ns}); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.AddNetns(p, ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Profiles a & c live in the namespace of the backup, b & d in another one
+	add("a", "10.0.0.1:80", "")
+	add("b", "10.0.0.2:80", "/run/netns/b")
+	add("c", "10.0.0.3:80", "")
+	add("d", "10.0.0.4:80", "/run/netns/b")
+	if err := d.SetPrefix("IPTLB"); err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := d.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After the backup: a and b changed, c was deleted, e was added in each namespace
+	for _, p := range []string{"a", "b"} {
+		if err := d.AddDestinations(p, []string{"10.0.1.2:80"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.DeleteProfile("c"); err != nil {
+		t.Fatal(err)
+	}
+	add("e", "10.0.0.5:80", "")
+	add("f", "10.0.0.6:80", "/run/netns/b")
+	if err := d.SetPrefix("LB"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = d.RestoreNetnsState(saved, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := d.ListProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "b", "c", "d", "f"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("profiles are %v, expected %v", got, want)
+	}
+
+	tests := []struct {
+		profile string
+		dest    bool
+	}{
+		{profile: "a", dest: false},
+		{profile: "b", dest: true},
+		{profile: "c", dest: false},
+	}
+	for _, tt := range tests {
+		p, err := d.GetProfile(tt.profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := p["destination"]; ok != tt.dest {
+			t.Errorf("profile %s has destinations %t, expected %t", tt.profile, ok, tt.dest)
+		}
+	}
+
+	if d.GetPrefix() != "LB" {
+		t.Errorf("prefix is %s, expected the current header to be kept", d.GetPrefix())
+	}
+}
@@ -2,9 +2,11 @@ package state
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/ulfox/dby/db"
+	"github.com/ulfox/iptlb/utils"
 	ipte "github.com/ulfox/iptlb/utils/logs"
 )
 
@@ -23,6 +25,10 @@ type DB struct {
 	Rules         *map[string]map[string][]string
 }
 
+// HeaderKey is the top-level key of the state that holds the settings of the
+// iptlb instance instead of a profile. Profile names can not start with _
+const HeaderKey = "_header"
+
 // NewStateFactory for creating a new yaml db manager
 func NewStateFactory(path string) (*DB, error) {
 	yamlDBManager, err := db.NewStorageFactory(path)
@@ -38,7 +44,17 @@ func NewStateFactory(path string) (*DB, error) {
 	return state, nil
 }
 
-func (d *DB) checkSource(profile, src string) error {
+// SourceMatch holds the profile options that narrow down which packets sent
+// to a source are captured. Profiles that capture the same source do not
+// conflict when their matches can not select the same packet
+type SourceMatch struct {
+	InInterface, OutInterface, Netns string
+}
+
+// checkSource checks that no other profile captures src in the same network
+// namespace on an interface that overlaps with the interfaces of m.
+// An empty interface matches every interface
+func (d *DB) checkSource(profile, src string, m SourceMatch) error {
 	keys, err := d.Storage.FindKeys("source")
 	if err != nil {
 		return err
@@ -49,22 +65,35 @@ func (d *DB) checkSource(profile, src string) error {
 	}
 
 	for _, j := range keys {
+		// Only the sources of the profiles, not of their revisions
+		if strings.Count(j, ".") != 1 {
+			continue
+		}
+
 		value, err := d.Storage.GetPath(j)
 		if err != nil {
 			return nil
 		}
 
 		if src == value.(string) {
-			if strings.Split(j, ".")[0] == profile {
+			p := strings.Split(j, ".")[0]
+			if p == profile {
 				return nil
 			}
+
+			if m.Netns != d.getString(p, "netns") ||
+				!utils.InterfacesOverlap(m.InInterface, d.getString(p, "inInterface")) ||
+				!utils.InterfacesOverlap(m.OutInterface, d.getString(p, "outInterface")) {
+				continue
+			}
+
 			return fmt.Errorf(
 				fmt.Sprintf(
 					ipte.ErrSourceAlreadyExists,
 					src,
-					strings.Split(j, ".")[0],
-					strings.Split(j, ".")[0],
-					strings.Split(j, ".")[0],
+					p,
+					p,
+					p,
 				),
 			)
 		}
@@ -73,6 +102,21 @@ func (d *DB) checkSource(profile, src string) error {
 	return nil
 }
 
+// getString returns the string value of a profile key or an empty
+// string if the key does not exist
+func (d *DB) getString(profile, key string) string {
+	value, err := d.Storage.GetPath(fmt.Sprintf("%s.%s", profile, key))
+	if err != nil {
+		return ""
+	}
+
+	v, _ := value.(string)
+	return v
+}
+
+// checkKey returns an error if profile already has key. Only the key of the profile
+// itself counts, not the keys of profiles whose name starts with the name of profile
+// (web2.source for profile web) or the keys kept in revisions (web.revisions.0.source)
 func (d *DB) checkKey(profile, key string) error {
 	keys, err := d.Storage.FindKeys(key)
 	if err != nil {
@@ -80,16 +124,17 @@ func (d *DB) checkKey(profile, key string) error {
 	}
 
 	for _, v := range keys {
-		if strings.HasPrefix(v, profile) {
+		if v == fmt.Sprintf("%s.%s", profile, key) {
 			return fmt.Errorf(ipte.ErrKeyAlreadyExists, strings.Split(v, ".")[0], profile)
 		}
 	}
 	return nil
 }
 
-// AddSource writing src (ipv4:port) on local state
-func (d *DB) AddSource(profile, src string) error {
-	err := d.checkSource(profile, src)
+// AddSource writing src (ipv4:port) on local state. The match options of
+// the profile are used to detect conflicts with other profiles
+func (d *DB) AddSource(profile, src string, m SourceMatch) error {
+	err := d.checkSource(profile, src, m)
 	if err != nil {
 		return err
 	}
@@ -128,10 +173,103 @@ func (d *DB) AddDestinations(profile string, dest []string) error {
 	return nil
 }
 
+// UpdateDestinations for replacing the dest array of an existing profile
+func (d *DB) UpdateDestinations(profile string, dest []string) error {
+	if dest == nil {
+		dest = []string{}
+	}
+
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "destination"),
+		dest,
+	)
+}
+
+// AddBackupDestinations for writing the backup tier destinations of a profile
+func (d *DB) AddBackupDestinations(profile string, dest []string) error {
+	if dest == nil {
+		dest = []string{}
+	}
+
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "backupDestination"),
+		dest,
+	)
+}
+
+// AddLabels for writing the labels of a profile
+func (d *DB) AddLabels(profile string, labels map[string]string) error {
+	if labels == nil {
+		labels = map[string]string{}
+	}
+
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "labels"),
+		labels,
+	)
+}
+
+// GetLabels returns the labels of a profile. Profiles written before labels
+// were supported have no labels
+func (d *DB) GetLabels(profile string) map[string]string {
+	labels := make(map[string]string)
+
+	data, err := d.Storage.GetPath(fmt.Sprintf("%s.%s", profile, "labels"))
+	if err != nil {
+		return labels
+	}
+
+	switch m := data.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range m {
+			labels[fmt.Sprintf("%v", k)] = fmt.Sprintf("%v", v)
+		}
+	case map[string]string:
+		for k, v := range m {
+			labels[k] = v
+		}
+	}
+
+	return labels
+}
+
+// AddExpiresAt for writing the time (RFC3339) a profile expires at. An empty
+// string means the profile does not expire
+func (d *DB) AddExpiresAt(profile, expiresAt string) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "expiresAt"),
+		expiresAt,
+	)
+}
+
+// AddChainName for writing the name that the chains of a profile are created with
+func (d *DB) AddChainName(profile, chainName string) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "chainName"),
+		chainName,
+	)
+}
+
+// AddEnabled for writing if the rules of a profile are applied
+func (d *DB) AddEnabled(profile string, enabled bool) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "enabled"),
+		enabled,
+	)
+}
+
+// AddActiveTier for writing the destination tier that is in the custom chain of a profile
+func (d *DB) AddActiveTier(profile string, tier int) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "activeTier"),
+		tier,
+	)
+}
+
 // DeleteProfile for deleting a profile from the local state
 func (d *DB) DeleteProfile(profile string) error {
-	err := d.checkKey(profile, profile)
-	if err == nil {
+	_, err := d.Storage.GetPath(profile)
+	if err != nil {
 		return fmt.Errorf(fmt.Sprintf(ipte.ErrProfileNotExist, profile))
 	}
 
@@ -190,3 +328,242 @@ func (d *DB) AddRulesBackend(profile, rulesBackend string) error {
 
 	return nil
 }
+
+func (d *DB) AddClientCIDR(profile string, clientCIDR []string) error {
+	if clientCIDR == nil {
+		clientCIDR = []string{}
+	}
+
+	err := d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "clientCIDR"),
+		clientCIDR,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *DB) AddInterfaces(profile, inIface, outIface string) error {
+	err := d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "inInterface"),
+		inIface,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "outInterface"),
+		outIface,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *DB) AddNetns(profile, netns string) error {
+	err := d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "netns"),
+		netns,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (d *DB) AddLBMode(profile, lbMode string, hashPort bool) error {
+	err := d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "lbMode"),
+		lbMode,
+	)
+	if err != nil {
+		return err
+	}
+
+	err = d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "hashPort"),
+		hashPort,
+	)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Limits of a profile. Zero values disable a limit
+type Limits struct {
+	RateLimit, RateLimitKey, LimitAction string
+	RateLimitBurst, MaxConnsPerDest      int
+}
+
+func (d *DB) AddLimits(profile string, l Limits) error {
+	values := map[string]interface{}{
+		"rateLimit":       l.RateLimit,
+		"rateLimitKey":    l.RateLimitKey,
+		"rateLimitBurst":  l.RateLimitBurst,
+		"maxConnsPerDest": l.MaxConnsPerDest,
+		"limitAction":     l.LimitAction,
+	}
+
+	for k, v := range values {
+		err := d.Storage.Upsert(
+			fmt.Sprintf("%s.%s", profile, k),
+			v,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *DB) AddFallback(profile, fallback, fallbackDest string) error {
+	err := d.Storage.Upsert(
+		fmt.Sprintf("%s.fallback", profile),
+		fallback,
+	)
+	if err != nil {
+		return err
+	}
+
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.fallbackDest", profile),
+		fallbackDest,
+	)
+}
+
+// GetPrefix returns the chain prefix of the state header or an empty string
+// if the state has no header
+func (d *DB) GetPrefix() string {
+	value, err := d.Storage.GetPath(fmt.Sprintf("%s.%s", HeaderKey, "chainPrefix"))
+	if err != nil {
+		return ""
+	}
+
+	v, _ := value.(string)
+	return v
+}
+
+// SetPrefix for writing the chain prefix to the state header
+func (d *DB) SetPrefix(prefix string) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", HeaderKey, "chainPrefix"),
+		prefix,
+	)
+}
+
+// ListProfiles returns the names of all profiles in the state, sorted.
+// The state header is not a profile
+func (d *DB) ListProfiles() ([]string, error) {
+	data, ok := d.Storage.GetData().(map[interface{}]interface{})
+	if !ok {
+		return nil, fmt.Errorf("state [%s] is not a map of profiles", d.Storage.Path)
+	}
+
+	profiles := make([]string, 0, len(data))
+	for k := range data {
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("possibly corrupted key in db [%v]", k)
+		}
+		if key == HeaderKey {
+			continue
+		}
+		profiles = append(profiles, key)
+	}
+	sort.Strings(profiles)
+
+	return profiles, nil
+}
+
+// NetnsInUse reports if any profile of the state is applied in netns ns
+func (d *DB) NetnsInUse(ns string) (bool, error) {
+	profiles, err := d.ListProfiles()
+	if err != nil {
+		return false, err
+	}
+
+	for _, p := range profiles {
+		if d.getString(p, "netns") == ns {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// GetProfile returns a copy of the profile's state, without its revisions, that
+// can be safely kept around or encoded to json. If the profile does not exist
+// nil is returned
+func (d *DB) GetProfile(profile string) (map[string]interface{}, error) {
+	data, err := d.Storage.GetPath(profile)
+	if err != nil {
+		if data == nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	copied, ok := copyValue(data).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("profile [%s] is not a map", profile)
+	}
+	delete(copied, "revisions")
+
+	return copied, nil
+}
+
+// GetRevisions returns the revisions of a profile, oldest first. Profiles written
+// before revisions were kept have none
+func (d *DB) GetRevisions(profile string) []interface{} {
+	data, err := d.Storage.GetPath(fmt.Sprintf("%s.%s", profile, "revisions"))
+	if err != nil {
+		return nil
+	}
+
+	revisions, _ := data.([]interface{})
+	return revisions
+}
+
+// SetRevisions for writing the revisions of a profile
+func (d *DB) SetRevisions(profile string, revisions []interface{}) error {
+	return d.Storage.Upsert(
+		fmt.Sprintf("%s.%s", profile, "revisions"),
+		revisions,
+	)
+}
+
+// copyValue deep copies a yaml value, converting yaml maps to maps
+// with string keys
+func copyValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, j := range t {
+			m[fmt.Sprintf("%v", k)] = copyValue(j)
+		}
+		return m
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, j := range t {
+			m[k] = copyValue(j)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(t))
+		for i, j := range t {
+			a[i] = copyValue(j)
+		}
+		return a
+	default:
+		return t
+	}
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckKey(t *testing.T) {
+	d, err := NewStateFactory(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.AddSource("web2", "10.0.0.2:80", SourceMatch{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddSource("api", "10.0.0.3:80", SourceMatch{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetRevisions("api", []interface{}{map[string]interface{}{"revision": 1, "destination": []string{"10.0.1.2:80"}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, profile, key string
+		exists             bool
+	}{
+		{name: "key of the profile", profile: "web2", key: "source", exists: true},
+		{name: "profile name is a prefix of another profile", profile: "web", key: "source"},
+		{name: "missing key of the profile", profile: "web2", key: "destination"},
+		{name: "key kept in a revision", profile: "api", key: "destination"},
+		{name: "new profile", profile: "db", key: "source"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := d.checkKey(tt.profile, tt.key)
+			if (err != nil) != tt.exists {
+				t.Errorf("checkKey(%s, %s) returned %v, expected the key to exist %t", tt.profile, tt.key, err, tt.exists)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+)
+
+// RulesBackends are the supported values of -rules-backend
+var RulesBackends = []string{"client", "proxy", "server"}
+
+// CheckRulesBackend checks if b is a supported rules backend
+func CheckRulesBackend(b string) error {
+	for _, j := range RulesBackends {
+		if b == j {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("rules backend [%s] is not valid. Expected one of %v", b, RulesBackends)
+}
+
+// LBModes are the supported values of -lb-mode
+var LBModes = []string{"random", "hash"}
+
+// CheckLBMode checks if m is a supported balancing mode
+func CheckLBMode(m string) error {
+	for _, j := range LBModes {
+		if m == j {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("lb mode [%s] is not valid. Expected one of %v", m, LBModes)
+}
+
+// IsLocalAddress returns true if ip is a loopback address or is assigned
+// to one of the host's interfaces
+func IsLocalAddress(ip string) (bool, error) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false, fmt.Errorf("IP [%s] is not a valid ip", ip)
+	}
+	if parsed.IsLoopback() {
+		return true, nil
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false, err
+	}
+
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if ok && ipNet.IP.Equal(parsed) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// SplitClientCIDRs splits a client cidr list into the allowed and the
+// denied (prefixed with !) cidrs
+func SplitClientCIDRs(c []string) ([]string, []string) {
+	var allow, deny []string
+	for _, j := range c {
+		if strings.HasPrefix(j, "!") {
+			deny = append(deny, strings.TrimPrefix(j, "!"))
+			continue
+		}
+		allow = append(allow, j)
+	}
+
+	return allow, deny
+}
+
+// CheckClientCIDRs checks if every entry of a client cidr list is an ipv4
+// cidr or address, optionally prefixed with !. IPv4-mapped ipv6 addresses
+// (::ffff:a.b.c.d) are not valid, since iptables only reads ipv4 notation
+func CheckClientCIDRs(c []string) error {
+	for _, j := range c {
+		cidr := strings.TrimPrefix(j, "!")
+		if strings.Contains(cidr, ":") {
+			return fmt.Errorf("client cidr [%s] is not valid. Expected ipv4/prefix", j)
+		}
+		if strings.Contains(cidr, "/") {
+			ip, _, err := net.ParseCIDR(cidr)
+			if err != nil || ip.To4() == nil {
+				return fmt.Errorf("client cidr [%s] is not valid. Expected ipv4/prefix", j)
+			}
+			continue
+		}
+
+		ip := net.ParseIP(cidr)
+		if ip == nil || ip.To4() == nil {
+			return fmt.Errorf("client cidr [%s] is not valid. Expected ipv4/prefix", j)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckClientCIDRs(t *testing.T) {
+	tests := []struct {
+		name  string
+		cidrs []string
+		err   bool
+	}{
+		{name: "empty list"},
+		{name: "address", cidrs: []string{"10.0.0.1"}},
+		{name: "cidr", cidrs: []string{"10.0.0.0/8"}},
+		{name: "cidr with host bits", cidrs: []string{"10.0.0.1/24"}},
+		{name: "zero and host prefix", cidrs: []string{"0.0.0.0/0", "10.0.0.1/32"}},
+		{name: "negated", cidrs: []string{"10.0.0.0/8", "!10.0.1.0/24", "!10.0.2.1"}},
+		{name: "prefix too long", cidrs: []string{"10.0.0.0/33"}, err: true},
+		{name: "negative prefix", cidrs: []string{"10.0.0.0/-1"}, err: true},
+		{name: "missing prefix", cidrs: []string{"10.0.0.0/"}, err: true},
+		{name: "netmask prefix", cidrs: []string{"10.0.0.0/255.0.0.0"}, err: true},
+		{name: "octet out of range", cidrs: []string{"10.0.0.256"}, err: true},
+		{name: "short address", cidrs: []string{"10.0.0"}, err: true},
+		{name: "hostname", cidrs: []string{"example.com"}, err: true},
+		{name: "ipv6 address", cidrs: []string{"fd00::1"}, err: true},
+		{name: "ipv6 cidr", cidrs: []string{"fd00::/8"}, err: true},
+		{name: "ipv4-mapped ipv6 address", cidrs: []string{"::ffff:10.0.0.1"}, err: true},
+		{name: "ipv4-mapped ipv6 cidr", cidrs: []string{"::ffff:10.0.0.0/120"}, err: true},
+		{name: "empty entry", cidrs: []string{""}, err: true},
+		{name: "lone negation", cidrs: []string{"!"}, err: true},
+		{name: "double negation", cidrs: []string{"!!10.0.0.1"}, err: true},
+		{name: "spaces", cidrs: []string{" 10.0.0.1"}, err: true},
+		{name: "one invalid entry", cidrs: []string{"10.0.0.0/8", "10.0.0.0/40"}, err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckClientCIDRs(tt.cidrs)
+			if tt.err && err == nil {
+				t.Errorf("%q: expected an error", tt.cidrs)
+			}
+			if !tt.err && err != nil {
+				t.Errorf("%q: %s", tt.cidrs, err)
+			}
+		})
+	}
+}
+
+func TestSplitClientCIDRs(t *testing.T) {
+	tests := []struct {
+		name      string
+		cidrs     []string
+		wantAllow []string
+		wantDeny  []string
+	}{
+		{name: "empty list"},
+		{name: "allowed", cidrs: []string{"10.0.0.0/8", "10.1.0.1"}, wantAllow: []string{"10.0.0.0/8", "10.1.0.1"}},
+		{name: "denied", cidrs: []string{"!10.0.0.0/8"}, wantDeny: []string{"10.0.0.0/8"}},
+		{
+			name:      "mixed",
+			cidrs:     []string{"10.0.0.0/8", "!10.0.1.0/24", "192.168.0.0/16", "!10.0.2.1"},
+			wantAllow: []string{"10.0.0.0/8", "192.168.0.0/16"},
+			wantDeny:  []string{"10.0.1.0/24", "10.0.2.1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allow, deny := SplitClientCIDRs(tt.cidrs)
+			if !reflect.DeepEqual(allow, tt.wantAllow) || !reflect.DeepEqual(deny, tt.wantDeny) {
+				t.Errorf("split %q into %q and %q, expected %q and %q", tt.cidrs, allow, deny, tt.wantAllow, tt.wantDeny)
+			}
+		})
+	}
+}
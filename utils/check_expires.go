@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"fmt"
+	"time"
+)
+
+// CheckExpiresAt checks that the expiration time of a profile is empty (the
+// profile does not expire) or an RFC3339 time
+func CheckExpiresAt(expiresAt string) error {
+	if expiresAt == "" {
+		return nil
+	}
+
+	_, err := time.Parse(time.RFC3339, expiresAt)
+	if err != nil {
+		return fmt.Errorf("expiration time [%s] is not valid. Expected RFC3339, e.g. 2006-01-02T15:04:05Z", expiresAt)
+	}
+
+	return nil
+}
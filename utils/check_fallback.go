@@ -0,0 +1,29 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckFallback checks the fallback options of a profile. A profile can either
+// reject or send to a fallback destination the connections no destination took
+func CheckFallback(fallback, fallbackDest string) error {
+	if fallback != "" && fallback != "reject" {
+		return fmt.Errorf("fallback [%s] is not valid. Expected reject", fallback)
+	}
+
+	if fallbackDest == "" {
+		return nil
+	}
+
+	if fallback != "" {
+		return fmt.Errorf("fallback [%s] is incompatible with fallback destination [%s]", fallback, fallbackDest)
+	}
+
+	strSlice := strings.Split(fallbackDest, ":")
+	if len(strSlice) != 2 || strSlice[0] == "" || strSlice[1] == "" {
+		return fmt.Errorf("fallback destination [%s] is not valid. Expected ip:port", fallbackDest)
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// maxInterfaceLen is the longest interface name the kernel accepts (IFNAMSIZ - 1)
+const maxInterfaceLen = 15
+
+// checkInterface checks if i is a valid interface name for -i/-o matches.
+// A trailing + is a wildcard (e.g. eth+ matches eth0, eth1, ...)
+func checkInterface(i string) error {
+	if len(i) > maxInterfaceLen {
+		return fmt.Errorf("interface [%s] is longer than %d characters", i, maxInterfaceLen)
+	}
+
+	name := strings.TrimSuffix(i, "+")
+	if strings.ContainsAny(name, " \t/:+!") {
+		return fmt.Errorf("interface [%s] is not valid", i)
+	}
+
+	return nil
+}
+
+// CheckInterfaces checks the in & out interfaces of a profile. The in interface
+// can only be matched on the proxy & server backends (PREROUTING/INPUT) and the
+// out interface only on the client backend (OUTPUT)
+func CheckInterfaces(rulesBackend, in, out string) error {
+	if in != "" {
+		if err := checkInterface(in); err != nil {
+			return err
+		}
+		if rulesBackend == "client" {
+			return fmt.Errorf("-in-interface can not be used with rules backend [client]. Use -out-interface")
+		}
+	}
+
+	if out != "" {
+		if err := checkInterface(out); err != nil {
+			return err
+		}
+		if rulesBackend != "client" {
+			return fmt.Errorf("-out-interface can not be used with rules backend [%s]. Use -in-interface", rulesBackend)
+		}
+	}
+
+	return nil
+}
+
+// InterfacesOverlap returns true if a packet can match both interface a and b.
+// An empty interface matches every interface and a trailing + is a wildcard
+func InterfacesOverlap(a, b string) bool {
+	if a == "" || b == "" {
+		return true
+	}
+
+	aWild, bWild := strings.HasSuffix(a, "+"), strings.HasSuffix(b, "+")
+	a, b = strings.TrimSuffix(a, "+"), strings.TrimSuffix(b, "+")
+
+	switch {
+	case aWild && bWild:
+		return strings.HasPrefix(a, b) || strings.HasPrefix(b, a)
+	case aWild:
+		return strings.HasPrefix(b, a)
+	case bWild:
+		return strings.HasPrefix(a, b)
+	}
+
+	return a == b
+}
@@ -0,0 +1,80 @@
+package utils
+
+import "testing"
+
+func TestInterfacesOverlap(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "", b: "", want: true},
+		{a: "", b: "eth0", want: true},
+		{a: "eth0", b: "", want: true},
+		{a: "", b: "eth+", want: true},
+		{a: "eth0", b: "eth0", want: true},
+		{a: "eth0", b: "eth1", want: false},
+		{a: "eth0", b: "eth0.100", want: false},
+		{a: "eth+", b: "eth0", want: true},
+		{a: "eth0", b: "eth+", want: true},
+		{a: "eth+", b: "eth", want: true},
+		{a: "eth+", b: "et", want: false},
+		{a: "eth+", b: "wlan0", want: false},
+		{a: "eth+", b: "eth0+", want: true},
+		{a: "eth0+", b: "eth1+", want: false},
+		{a: "eth+", b: "wlan+", want: false},
+		{a: "veth+", b: "eth+", want: false},
+		{a: "+", b: "eth0", want: true},
+		{a: "+", b: "wlan+", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.a+"_"+tt.b, func(t *testing.T) {
+			if got := InterfacesOverlap(tt.a, tt.b); got != tt.want {
+				t.Errorf("InterfacesOverlap(%q, %q) is %t, expected %t", tt.a, tt.b, got, tt.want)
+			}
+			if got := InterfacesOverlap(tt.b, tt.a); got != tt.want {
+				t.Errorf("InterfacesOverlap(%q, %q) is %t, expected %t", tt.b, tt.a, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckInterfaces(t *testing.T) {
+	tests := []struct {
+		name         string
+		rulesBackend string
+		in, out      string
+		err          bool
+	}{
+		{name: "no interfaces", rulesBackend: "proxy"},
+		{name: "proxy in", rulesBackend: "proxy", in: "eth0"},
+		{name: "server in wildcard", rulesBackend: "server", in: "eth+"},
+		{name: "client out", rulesBackend: "client", out: "wg0"},
+		{name: "client out wildcard", rulesBackend: "client", out: "+"},
+		{name: "longest name", rulesBackend: "proxy", in: "abcdefghijklmno"},
+		{name: "longest wildcard", rulesBackend: "proxy", in: "abcdefghijklmn+"},
+		{name: "too long", rulesBackend: "proxy", in: "abcdefghijklmnop", err: true},
+		{name: "too long wildcard", rulesBackend: "proxy", in: "abcdefghijklmno+", err: true},
+		{name: "client in", rulesBackend: "client", in: "eth0", err: true},
+		{name: "proxy out", rulesBackend: "proxy", out: "eth0", err: true},
+		{name: "server out", rulesBackend: "server", out: "eth+", err: true},
+		{name: "inner wildcard", rulesBackend: "proxy", in: "et+h", err: true},
+		{name: "double wildcard", rulesBackend: "proxy", in: "eth++", err: true},
+		{name: "negated", rulesBackend: "proxy", in: "!eth0", err: true},
+		{name: "space", rulesBackend: "proxy", in: "eth 0", err: true},
+		{name: "slash", rulesBackend: "client", out: "eth/0", err: true},
+		{name: "colon", rulesBackend: "proxy", in: "eth0:1", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckInterfaces(tt.rulesBackend, tt.in, tt.out)
+			if tt.err && err == nil {
+				t.Error("expected an error")
+			}
+			if !tt.err && err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// rateRegex matches the hashlimit rate format, e.g. 100/second or 10/m
+var rateRegex = regexp.MustCompile(`^[1-9][0-9]*/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+
+// CheckLimits checks the rate & connection limit options of a profile
+func CheckLimits(rate, key, action string, burst, maxConns int) error {
+	if rate != "" && !rateRegex.MatchString(rate) {
+		return fmt.Errorf("rate limit [%s] is not valid. Expected N/second, N/minute, N/hour or N/day", rate)
+	}
+
+	if key != "" && key != "client" && key != "global" {
+		return fmt.Errorf("rate limit key [%s] is not valid. Expected client or global", key)
+	}
+
+	if action != "" && action != "drop" && action != "reject" {
+		return fmt.Errorf("limit action [%s] is not valid. Expected drop or reject", action)
+	}
+
+	if burst < 0 {
+		return fmt.Errorf("rate limit burst [%d] can not be negative", burst)
+	}
+
+	if maxConns < 0 {
+		return fmt.Errorf("max connections per destination [%d] can not be negative", maxConns)
+	}
+
+	return nil
+}
@@ -0,0 +1,21 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+)
+
+// CheckNetns checks if p points to a network namespace. An empty path
+// stands for the namespace iptlb runs in
+func CheckNetns(p string) error {
+	if p == "" {
+		return nil
+	}
+
+	_, err := os.Stat(p)
+	if err != nil {
+		return fmt.Errorf("netns [%s] is not valid: %s", p, err)
+	}
+
+	return nil
+}
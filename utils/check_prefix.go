@@ -0,0 +1,20 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// prefixRegex matches the valid chain prefixes
+var prefixRegex = regexp.MustCompile(`^[A-Z][A-Z0-9]{0,7}$`)
+
+// CheckPrefix checks that a chain prefix is 1 to 8 upper-case alphanumerics
+// and starts with a letter. Without _ a prefix can not be the start of another one
+// followed by _, e.g. IPTLB and IPTLB_B
+func CheckPrefix(p string) error {
+	if !prefixRegex.MatchString(p) {
+		return fmt.Errorf("chain prefix [%s] is not valid. Expected 1 to 8 upper-case alphanumerics, starting with a letter", p)
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// profileRegex matches the valid profile names
+var profileRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,63}$`)
+
+// CheckProfileName checks that a profile name is 1 to 64 alphanumerics, - and _
+// and starts with an alphanumeric
+func CheckProfileName(p string) error {
+	if !profileRegex.MatchString(p) {
+		return fmt.Errorf("profile name [%s] is not valid. Expected 1 to 64 alphanumerics, - and _, starting with an alphanumeric", p)
+	}
+
+	return nil
+}
@@ -0,0 +1,17 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// CheckBackupDest checks that backup destinations are only given for tcp
+// profiles. The health check of the tiers is a tcp connect, so the destinations
+// of other protocols could never be found unhealthy
+func CheckBackupDest(protocol string, backupDest []string) error {
+	if len(backupDest) == 0 || protocol == "tcp" {
+		return nil
+	}
+
+	return fmt.Errorf("backup destinations [%s] are not supported for protocol [%s]. Expected tcp", strings.Join(backupDest, ","), protocol)
+}
@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// IPTLBConfigPath is the default path of the global config file
+var IPTLBConfigPath string = "/etc/iptlb/config.yaml"
+
+// ReadConfigFile reads the global config file at p into a map of k:v where
+// k is the name of a flag, e.g. state-file. Lists are joined with commas.
+// A missing file is an empty config, unless required is set
+func ReadConfigFile(p string, required bool) (map[string]string, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		if os.IsNotExist(err) && !required {
+			return map[string]string{}, nil
+		}
+		return nil, err
+	}
+
+	var raw map[string]interface{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("config file [%s] is not valid: %s", p, err)
+	}
+
+	config := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch value := v.(type) {
+		case nil:
+			config[k] = ""
+		case []interface{}:
+			items := make([]string, 0, len(value))
+			for _, j := range value {
+				items = append(items, fmt.Sprint(j))
+			}
+			config[k] = strings.Join(items, ",")
+		case map[interface{}]interface{}:
+			return nil, fmt.Errorf("config file [%s]: value of [%s] is not a scalar or a list", p, k)
+		default:
+			config[k] = fmt.Sprint(value)
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelRegex matches label keys and non empty label values
+var labelRegex = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_-]*[A-Za-z0-9])?$`)
+
+// ParseLabels parses a comma-separated list of key=value labels
+func ParseLabels(s string) (map[string]string, error) {
+	labels := make(map[string]string)
+	if s == "" {
+		return labels, nil
+	}
+
+	for _, j := range strings.Split(s, ",") {
+		kv := strings.SplitN(j, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("label [%s] is not valid. Expected key=value", j)
+		}
+		if !labelRegex.MatchString(kv[0]) {
+			return nil, fmt.Errorf("label key [%s] is not valid. Expected alphanumerics, - and _", kv[0])
+		}
+		if kv[1] != "" && !labelRegex.MatchString(kv[1]) {
+			return nil, fmt.Errorf("label value [%s] is not valid. Expected alphanumerics, - and _", kv[1])
+		}
+		if _, ok := labels[kv[0]]; ok {
+			return nil, fmt.Errorf("label key [%s] is given more than once", kv[0])
+		}
+		labels[kv[0]] = kv[1]
+	}
+
+	return labels, nil
+}
+
+// FormatLabels returns labels as a sorted comma-separated list of key=value
+func FormatLabels(labels map[string]string) string {
+	l := make([]string, 0, len(labels))
+	for k, v := range labels {
+		l = append(l, fmt.Sprintf("%s=%s", k, v))
+	}
+	sort.Strings(l)
+
+	return strings.Join(l, ",")
+}
+
+// requirement is a single term of a Selector
+type requirement struct {
+	key, value string
+	op         string
+}
+
+// Selector selects profiles by their labels. All the requirements of
+// a Selector must match
+type Selector []requirement
+
+// ParseSelector parses a comma-separated list of requirements:
+// key=value (or key==value), key!=value, key (the label exists) and
+// !key (the label does not exist). An empty string selects everything
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	if s == "" {
+		return sel, nil
+	}
+
+	for _, j := range strings.Split(s, ",") {
+		var r requirement
+		switch {
+		case strings.Contains(j, "!="):
+			kv := strings.SplitN(j, "!=", 2)
+			r = requirement{key: kv[0], value: kv[1], op: "!="}
+		case strings.Contains(j, "=="):
+			kv := strings.SplitN(j, "==", 2)
+			r = requirement{key: kv[0], value: kv[1], op: "="}
+		case strings.Contains(j, "="):
+			kv := strings.SplitN(j, "=", 2)
+			r = requirement{key: kv[0], value: kv[1], op: "="}
+		case strings.HasPrefix(j, "!"):
+			r = requirement{key: strings.TrimPrefix(j, "!"), op: "!"}
+		default:
+			r = requirement{key: j, op: "exists"}
+		}
+
+		if !labelRegex.MatchString(r.key) {
+			return nil, fmt.Errorf("selector [%s] is not valid. Label key [%s] is not valid", j, r.key)
+		}
+		if r.value != "" && !labelRegex.MatchString(r.value) {
+			return nil, fmt.Errorf("selector [%s] is not valid. Label value [%s] is not valid", j, r.value)
+		}
+		sel = append(sel, r)
+	}
+
+	return sel, nil
+}
+
+// Matches returns true if labels satisfy every requirement of the Selector
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s {
+		v, ok := labels[r.key]
+		switch r.op {
+		case "=":
+			if !ok || v != r.value {
+				return false
+			}
+		case "!=":
+			if ok && v == r.value {
+				return false
+			}
+		case "!":
+			if ok {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,116 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseLabels(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+		err  bool
+	}{
+		{in: "", want: map[string]string{}},
+		{in: "env=prod", want: map[string]string{"env": "prod"}},
+		{in: "env=prod,team=net-ops,tier=", want: map[string]string{"env": "prod", "team": "net-ops", "tier": ""}},
+		{in: "env", err: true},
+		{in: "=prod", err: true},
+		{in: "env=prod,", err: true},
+		{in: "env=pro d", err: true},
+		{in: "env=prod,env=dev", err: true},
+		{in: "-env=prod", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseLabels(tt.in)
+			if tt.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("labels are %v, expected %v", got, tt.want)
+			}
+			if FormatLabels(got) != tt.in {
+				t.Errorf("labels are formatted as %s, expected %s", FormatLabels(got), tt.in)
+			}
+		})
+	}
+}
+
+func TestParseSelector(t *testing.T) {
+	tests := []struct {
+		in  string
+		err bool
+	}{
+		{in: ""},
+		{in: "env=prod"},
+		{in: "env==prod"},
+		{in: "env!=prod"},
+		{in: "env"},
+		{in: "!env"},
+		{in: "env=prod,team!=db,tier,!canary"},
+		{in: "env="},
+		{in: "env=prod,", err: true},
+		{in: ",env=prod", err: true},
+		{in: "=prod", err: true},
+		{in: "!=prod", err: true},
+		{in: "!", err: true},
+		{in: "env=pro d", err: true},
+		{in: "env=a=b", err: true},
+		{in: "e nv", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := ParseSelector(tt.in)
+			if (err != nil) != tt.err {
+				t.Errorf("error is %v, expected an error %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSelectorMatches(t *testing.T) {
+	labels := map[string]string{"env": "prod", "team": "net", "tier": ""}
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{selector: "", want: true},
+		{selector: "env=prod", want: true},
+		{selector: "env==prod", want: true},
+		{selector: "env=dev", want: false},
+		{selector: "owner=me", want: false},
+		{selector: "env!=dev", want: true},
+		{selector: "env!=prod", want: false},
+		{selector: "owner!=me", want: true},
+		{selector: "team", want: true},
+		{selector: "owner", want: false},
+		{selector: "!owner", want: true},
+		{selector: "!env", want: false},
+		{selector: "tier=", want: true},
+		{selector: "env=prod,team=net,!owner", want: true},
+		{selector: "env=prod,team=db", want: false},
+		{selector: "env!=dev,owner", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			sel, err := ParseSelector(tt.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := sel.Matches(labels); got != tt.want {
+				t.Errorf("matches is %t, expected %t", got, tt.want)
+			}
+		})
+	}
+}
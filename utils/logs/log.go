@@ -24,45 +24,176 @@ var (
 	// ErrChainNotFound when we can not get a chain after the creation
 	ErrChainNotFound = "Table[%s]/Chain[%s] not in the list"
 
+	// ErrLogFormat when an unknown -output-log-format is given
+	ErrLogFormat = "output log format [%s] is not valid. Expected json or text"
+
+	// ErrOutput when an unknown -output is given
+	ErrOutput = "output [%s] is not valid. Expected json or text"
+
+	// ErrVerbosity when an unknown -verbosity is given
+	ErrVerbosity = "verbosity [%s] is not valid. Expected debug, info, warn or error"
+
+	// ErrDestAlreadyExists when adding a destination that a profile already has
+	ErrDestAlreadyExists = "destination [%s] already defined on profile [%s]"
+
+	// ErrDestNotExist when removing a destination that a profile does not have
+	ErrDestNotExist = "destination [%s] is not defined on profile [%s]"
+
+	// ErrChainNotApplied when a profile's chain is expected to exist but it does not
+	ErrChainNotApplied = "Table[%s]/Chain[%s] does not exist. " +
+		"Apply profile [%s] first with -run"
+
+	// ErrNoRevision when rolling back a profile that has no revision before the latest one
+	ErrNoRevision = "profile [%s] has no earlier revision"
+
+	// ErrRevisionNotExist when rolling back to a revision that a profile does not have
+	ErrRevisionNotExist = "revision [%d] of profile [%s] does not exist"
+
+	// ErrPrefixChange when -chain-prefix differs from the prefix of a state that has profiles
+	ErrPrefixChange = "state [%s] has profiles with chain prefix [%s]. " +
+		"Delete them before changing the prefix to [%s]"
+
+	// ErrRevertChain when a chain could not be put back after a failed state write
+	ErrRevertChain = "Failed to revert the chain after the state write failed. Re-apply the profile with -reset"
+
+	// ErrConfigKey when the config file has a setting that is not a flag
+	ErrConfigKey = "unknown setting [%s] in config file [%s]"
+
+	// ErrConfigValue when a value from the environment or the config file is not valid for its flag
+	ErrConfigValue = "invalid value [%s] for [%s] from %s: %s"
+
+	// ErrReplayFailed when profiles of a -use-state replay could not be applied
+	ErrReplayFailed = "%d of %d profiles failed to apply"
+
+	// ErrGCFailed when expired profiles could not be deleted by gc
+	ErrGCFailed = "%d expired profiles could not be deleted"
+
 	// WarnDelete issue warning when --delete flag is set
-	WarnDelete = "Delete has been enabled. Deleting rules from profile [%s]"
+	WarnDelete = "Delete has been enabled. Deleting rules from profile"
 
 	// WarnReset issue warning when --reset flag is set
-	WarnReset = "Reset has been enabled. Resetting rules from profile [%s]"
+	WarnReset = "Reset has been enabled. Resetting rules from profile"
+
+	// WarnChainReverted when a chain is put back because the state write failed
+	WarnChainReverted = "State write failed. Reverted the chain to its previous rules"
+
+	// WarnUnknownEnv when an IPTLB_* environment variable matches no flag
+	WarnUnknownEnv = "Ignoring IPTLB environment variable that matches no flag"
+
+	// WarnConfigUnreadable when the default config file exists but can not be read
+	WarnConfigUnreadable = "Skipping config file that can not be read"
+
+	// WarnReplayCommit when the batched changes of a replay fail and each profile is applied alone
+	WarnReplayCommit = "Batched changes failed. Applying each profile alone"
+
+	// WarnReplayProfile when a profile of a replay could not be applied
+	WarnReplayProfile = "Failed to apply profile"
+
+	// WarnGCProfile when gc could not delete an expired profile
+	WarnGCProfile = "Failed to collect profile"
+
+	// WarnNetnsSkipped when a network namespace of the state does not exist anymore
+	WarnNetnsSkipped = "Skipping network namespace that does not exist"
+
+	// WarnNetnsUnpin when the namespace pinned for a profile that failed could not be unpinned
+	WarnNetnsUnpin = "Could not unpin the network namespace of the failed profile"
+
+	// WarnGCRun when a run of gc -interval failed. The next run is still made
+	WarnGCRun = "Garbage collection failed. Retrying on the next interval"
 
 	// InfoInputValidation info for successful validation
 	InfoInputValidation = "Inputs validated successfuly"
 
 	// InfoProfileCFG when profile configuration finished successfully
-	InfoProfileCFG = "Done configuring profile [%s]"
+	InfoProfileCFG = "Done configuring profile"
 
 	// InfoProfileDelete when profile deletion finished successfully
-	InfoProfileDelete = "Done cleaning profile [%s]"
+	InfoProfileDelete = "Done cleaning profile"
 
 	// InfoInsertRuleAlreadyExists when inserting a new rule but it already exists
-	InfoInsertRuleAlreadyExists = "[Insert] Rule: [%s] at [%d] exists on table[%s]/chain[%s]"
+	InfoInsertRuleAlreadyExists = "[Insert] Rule exists"
 
 	// InfoInsertRule when inserting a new rule
-	InfoInsertRule = "[Insert] Rule: [%s] at [%d] on table[%s]/chain[%s]"
+	InfoInsertRule = "[Insert] Rule"
 
 	// InfoAppendRuleAlreadyExists when appending a new rule but it already exists
-	InfoAppendRuleAlreadyExists = "[Append] Rule: [%s] exists on table[%s]/chain[%s]"
+	InfoAppendRuleAlreadyExists = "[Append] Rule exists"
 
 	// InfoAppendRule when appending a new rule
-	InfoAppendRule = "[Append] Rule: [%s] on table[%s]/chain[%s]"
+	InfoAppendRule = "[Append] Rule"
 
 	// InfoDeleteRule when deleting a rule
-	InfoDeleteRule = "[Deleted] Rule: [%s] table[%s]/chain[%s]"
+	InfoDeleteRule = "[Deleted] Rule"
 
 	// InfoDoneChainCFG when we complete the update of a chain
-	InfoDoneChainCFG = "Done configuring table[%s]/chain[%s]"
+	InfoDoneChainCFG = "Done configuring chain"
 
 	// InfoChainDoesNotExist when we check if a chain exists
-	InfoChainDoesNotExist = "Chain [%s] on table [%s] does not exist. Creating..."
+	InfoChainDoesNotExist = "Chain does not exist. Creating..."
 
 	// InfoChainFound when a chain exists
-	InfoChainFound = "Chain [%s] on table [%s] found"
+	InfoChainFound = "Chain found"
+
+	// InfoReplaceChain when the rules of a chain are replaced atomically
+	InfoReplaceChain = "[Replace] Chain rules"
+
+	// InfoDestUpdated when the destinations of a profile are updated
+	InfoDestUpdated = "Updated profile destinations"
+
+	// InfoProfileEnabled when the rules of a disabled profile are applied again
+	InfoProfileEnabled = "Enabled profile"
+
+	// InfoProfileDisabled when the rules of a profile are removed and the profile is kept
+	InfoProfileDisabled = "Disabled profile"
+
+	// InfoProfileSkipDisabled when the rules of a disabled profile are not applied
+	InfoProfileSkipDisabled = "Skipping disabled profile"
+
+	// InfoReplayCommit when the batched changes of a replay are applied
+	InfoReplayCommit = "Applying the batched changes of the replay"
+
+	// InfoReplayDone when a replay applied every profile
+	InfoReplayDone = "Done replaying profiles"
+
+	// InfoProfileExpired when gc deletes a profile that has expired
+	InfoProfileExpired = "Deleting expired profile"
+
+	// InfoProfileUnchanged when a profile is defined again exactly as the state has it
+	InfoProfileUnchanged = "Profile is unchanged. Applying it from the state"
+
+	// InfoGCDone when a gc run is complete
+	InfoGCDone = "Done collecting garbage"
+
+	// InfoBackupSaved when the tables and the state were backed up before a change
+	InfoBackupSaved = "Saved backup"
+
+	// InfoBackupPruned when a backup beyond the retention count was removed
+	InfoBackupPruned = "Removed old backup"
+
+	// InfoBackupTableRestored when a table of a backup was restored
+	InfoBackupTableRestored = "Restored table from backup"
+
+	// InfoBackupRestored when the tables and the state of a backup were restored
+	InfoBackupRestored = "Done restoring backup"
+
+	// InfoRollback when a profile is rolled back to a revision
+	InfoRollback = "Rolling back profile"
+
+	// InfoRemoveOrphan when an iptlb chain or rule that no profile owns is removed
+	InfoRemoveOrphan = "Removing orphan"
+
+	// InfoTierSwitched when the active destination tier of a profile changes
+	InfoTierSwitched = "Switched active destination tier"
+
+	// InfoTierUnchanged when the active destination tier of a profile is still the highest healthy tier
+	InfoTierUnchanged = "Active destination tier unchanged"
+
+	// InfoDrainStart when we start waiting for the connections of a destination to finish
+	InfoDrainStart = "Draining destination"
+
+	// InfoDrainDone when a destination has no connections left or the grace period has passed
+	InfoDrainDone = "Done draining destination"
 
-	// InfoChainLoggingEnabled when logging is enabled for a chain
-	InfoChainLoggingEnabled = "Enabled logging to chain %s"
+	// InfoConntrackFlushed when the conntrack entries of a destination are deleted
+	InfoConntrackFlushed = "Deleted conntrack entries of destination"
 )
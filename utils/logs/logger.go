@@ -0,0 +1,36 @@
+package log
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NewLogger creates the logger used by iptlb itself. Format is one of
+// json/text and verbosity one of debug/info/warn/error
+func NewLogger(format, verbosity string) (*logrus.Logger, error) {
+	logger := logrus.New()
+
+	switch format {
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{})
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf(ErrLogFormat, format)
+	}
+
+	switch verbosity {
+	case "debug", "info", "warn", "error":
+	default:
+		return nil, fmt.Errorf(ErrVerbosity, verbosity)
+	}
+
+	level, err := logrus.ParseLevel(verbosity)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetLevel(level)
+
+	return logger, nil
+}
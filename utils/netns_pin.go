@@ -0,0 +1,86 @@
+package utils
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// NetnsPinPath is the directory where the network namespaces of -netns-pid are
+// pinned, next to the namespaces of ip netns
+var NetnsPinPath string = "/var/run/netns"
+
+// netnsPinPrefix is the name prefix of the namespaces that PinNetns pins
+const netnsPinPrefix = "iptlb-"
+
+// ProcNetns returns the path of the network namespace of process pid
+func ProcNetns(pid int) string {
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// SameNetns reports if paths a and b point to the same network namespace
+func SameNetns(a, b string) bool {
+	var sa, sb syscall.Stat_t
+	if a == "" || b == "" || syscall.Stat(a, &sa) != nil || syscall.Stat(b, &sb) != nil {
+		return false
+	}
+	return sa.Dev == sb.Dev && sa.Ino == sb.Ino
+}
+
+// PinNetns bind mounts the network namespace of process pid under NetnsPinPath
+// and returns the path of the mount. Unlike /proc/<pid>/ns/net, the path keeps
+// pointing to the namespace after the process exits or its pid is reused. The
+// name holds the inode of the namespace, so pinning a namespace again returns
+// the same path
+func PinNetns(pid int) (string, error) {
+	src := ProcNetns(pid)
+
+	var ns syscall.Stat_t
+	err := syscall.Stat(src, &ns)
+	if err != nil {
+		return "", fmt.Errorf("netns of pid [%d] is not valid: %s", pid, err)
+	}
+
+	path := filepath.Join(NetnsPinPath, fmt.Sprintf("%s%d", netnsPinPrefix, ns.Ino))
+
+	var pinned syscall.Stat_t
+	if syscall.Stat(path, &pinned) == nil && pinned.Dev == ns.Dev && pinned.Ino == ns.Ino {
+		return path, nil
+	}
+
+	err = os.MkdirAll(NetnsPinPath, 0755)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.OpenFile(path, os.O_RDONLY|os.O_CREATE, 0444)
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+
+	err = syscall.Mount(src, path, "none", syscall.MS_BIND, "")
+	if err != nil {
+		os.Remove(path)
+		return "", fmt.Errorf("pinning netns of pid [%d] to [%s]: %s", pid, path, err)
+	}
+
+	return path, nil
+}
+
+// IsPinnedNetns reports if p is a namespace pinned by PinNetns
+func IsPinnedNetns(p string) bool {
+	return filepath.Dir(p) == filepath.Clean(NetnsPinPath) && strings.HasPrefix(filepath.Base(p), netnsPinPrefix)
+}
+
+// UnpinNetns removes a namespace pinned by PinNetns. The namespace is freed once
+// no process or mount uses it anymore
+func UnpinNetns(p string) error {
+	err := syscall.Unmount(p, syscall.MNT_DETACH)
+	if err != nil && err != syscall.EINVAL {
+		return fmt.Errorf("unpinning netns [%s]: %s", p, err)
+	}
+
+	return os.Remove(p)
+}